@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"tcpgo/internal/devcert"
+)
+
+func main() {
+	dir := flag.String("dir", devcert.DefaultDir(), "directory for the CA and the generated certificates")
+	name := flag.String("name", "localhost", "file name of the generated certificate, without extension")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: devcert [flags] [host ...]\n\nhosts default to %v\n\n", devcert.DefaultHosts)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	hosts := flag.Args()
+	if len(hosts) == 0 {
+		hosts = devcert.DefaultHosts
+	}
+
+	ca, err := devcert.LoadOrCreateCA(*dir)
+	if err != nil {
+		log.Fatalf("could not load CA: %s\n", err)
+	}
+	certFile, keyFile, err := ca.WriteLeaf(*dir, *name, hosts)
+	if err != nil {
+		log.Fatalf("could not generate certificate: %s\n", err)
+	}
+
+	fmt.Printf("CA:          %s\n", ca.CertFile)
+	fmt.Printf("certificate: %s\n", certFile)
+	fmt.Printf("key:         %s\n", keyFile)
+	fmt.Printf("valid for:   %v\n\n", hosts)
+	fmt.Printf("trust the CA once, e.g. curl --cacert %s https://localhost:42069/\n", ca.CertFile)
+}
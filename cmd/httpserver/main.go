@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -10,74 +12,151 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"tcpgo/internal/devcert"
+	"tcpgo/internal/headers"
+	"tcpgo/internal/middleware"
 	"tcpgo/internal/request"
 	"tcpgo/internal/response"
+	"tcpgo/internal/router"
 	"tcpgo/internal/server"
+	"time"
 )
 
-const port = 42069
+const defaultAddr = ":42069"
+const shutdownTimeout = 10 * time.Second
+const restartTimeout = 10 * time.Second
 
-func handler(w response.Writer, req *request.Request) {
-	target := req.RequestLine.RequestTarget
-	if target == "/yourproblem" {
-		badRequestHandler(w, req)
-		return
-	}
+func newRouter() *router.Router {
+	r := router.New()
+	r.Handle("GET", "/yourproblem", badRequestHandler)
+	r.Handle("GET", "/myproblem", internalServerErrorHandler)
+	r.Handle("GET", "/video", videoHandler)
+	r.Handle("GET", "/httpbin/{path...}", httpbinHandler)
+	r.Handle("GET", "/{path...}", successHandler)
+	return r
+}
+
+func main() {
+	addr := flag.String("addr", defaultAddr, `address to listen on, e.g. ":42069" or "unix:///tmp/tcpgo.sock"`)
+	certFiles := flag.String("tls-cert", "", "comma-separated PEM certificate files, serves HTTPS when set")
+	keyFiles := flag.String("tls-key", "", "comma-separated PEM key files, one per -tls-cert")
+	clientCAFiles := flag.String("tls-client-ca", "", "comma-separated PEM CA files, requires client certificates signed by them")
+	devTLS := flag.Bool("dev-tls", false, "serve HTTPS with a certificate from a local development CA, see cmd/devcert")
+	flag.Parse()
 
-	if after, ok := strings.CutPrefix(target, "/httpbin/"); ok {
-		contentType := "text/html"
-		count := after
-		res, err := http.Get("https://httpbin.org/" + count)
+	// a listener from systemd or from the process we are replacing wins over -addr
+	listeners, err := server.ListenersFromEnv()
+	if err != nil {
+		log.Fatalf("Error picking up inherited listener: %v", err)
+	}
+	if len(listeners) > 1 {
+		// the server accepts on a single listener, the others would sit unanswered
+		log.Fatalf("Error picking up inherited listeners: got %d, only one is supported", len(listeners))
+	}
+	cfgs := []server.ServerCfg{server.NewAddr(*addr)}
+	if len(listeners) > 0 {
+		cfgs = append(cfgs, server.NewListener(listeners[0]))
+	}
+	if *certFiles != "" {
+		certs, err := certPairs(*certFiles, *keyFiles)
 		if err != nil {
-			w.WriteStatusLine(response.StatusInternalServerError)
-			w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(0), response.NewContentType(contentType), response.NewConnection("")))
-			return
+			log.Fatalf("Error reading TLS flags: %v", err)
 		}
+		cfgs = append(cfgs, server.NewCertificates(certs...))
+	}
+	if *devTLS && *certFiles == "" {
+		cert, err := devCertificate()
+		if err != nil {
+			log.Fatalf("Error generating development certificate: %v", err)
+		}
+		cfgs = append(cfgs, server.NewCertificates(cert))
+	}
+	if *clientCAFiles != "" {
+		pool, err := server.LoadCertPool(strings.Split(*clientCAFiles, ",")...)
+		if err != nil {
+			log.Fatalf("Error loading client CAs: %v", err)
+		}
+		cfgs = append(cfgs, server.NewClientCAs(pool))
+	}
 
-		w.WriteStatusLine(response.StatusOK)
-		w.WriteHeaders(response.NewResponseHeaders(response.NewContentType(contentType), response.NewTransferEncoding("chunked"), response.NewTrailer([]string{"X-Content-SHA256", "X-Content-Length"})))
-
-		fullBody := make([]byte, 0)
-		buffer := make([]byte, 1024)
-		defer res.Body.Close()
-		for {
-			n, err := res.Body.Read(buffer)
-			if n > 0 {
-				w.WriteChunkedBody(buffer[:n])
-				fullBody = append(fullBody, buffer[:n]...)
-			}
-
-			if err == io.EOF {
-				break
-			}
+	srv, err := server.ServeConfig(server.NewConfig(cfgs...), server.Chain(
+		newRouter().ServeRequest,
+		middleware.Logging(log.Default()),
+		middleware.Recovery(log.Default()),
+		middleware.RequestID(),
+		middleware.Timing(),
+	))
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	log.Println("Server started on", srv.Addr())
+	if err := server.NotifyReady(); err != nil {
+		log.Printf("Could not notify the previous process: %v", err)
+	}
 
-			if err != nil {
-				w.ResetBuffer()
-				w.WriteStatusLine(response.StatusInternalServerError)
-				w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(0), response.NewContentType(contentType), response.NewConnection(""), response.NewConnection("")))
-				return
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	for sig := range sigChan {
+		if sig == syscall.SIGHUP || sig == syscall.SIGUSR2 {
+			if !restart(srv) {
+				continue
 			}
 		}
+		break
+	}
 
-		w.WriteChunkedBodyDone()
-		sha256 := fmt.Sprintf("%x", sha256.Sum256(fullBody))
-		w.WriteBodyTrailers([]byte(fmt.Sprintf("%s: %s", "X-Content-SHA256", sha256)))
-		w.WriteBodyTrailers([]byte(fmt.Sprintf("%s: %s\r\n", "X-Content-Length", fmt.Sprintf("%d", len(fullBody)))))
-
-		log.Printf("%s", w.Buffer.Bytes())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Server stopped with connections still open: %v", err)
 		return
 	}
+	log.Println("Server gracefully stopped")
+}
 
-	if target == "/video" {
-		videoHandler(w, req)
-		return
+// certPairs matches the comma-separated -tls-cert and -tls-key values one to one
+func certPairs(certFiles, keyFiles string) ([]server.CertPair, error) {
+	certs := strings.Split(certFiles, ",")
+	keys := strings.Split(keyFiles, ",")
+	if len(certs) != len(keys) {
+		return nil, fmt.Errorf("%d certificates but %d keys", len(certs), len(keys))
 	}
+	pairs := make([]server.CertPair, len(certs))
+	for i := range certs {
+		pairs[i] = server.CertPair{CertFile: certs[i], KeyFile: keys[i]}
+	}
+	return pairs, nil
+}
 
-	if target == "/myproblem" {
-		internalServerErrorHandler(w, req)
-		return
+// devCertificate issues a fresh localhost certificate from the shared development CA
+func devCertificate() (server.CertPair, error) {
+	dir := devcert.DefaultDir()
+	ca, err := devcert.LoadOrCreateCA(dir)
+	if err != nil {
+		return server.CertPair{}, err
+	}
+	certFile, keyFile, err := ca.WriteLeaf(dir, "httpserver", devcert.DefaultHosts)
+	if err != nil {
+		return server.CertPair{}, err
+	}
+	log.Println("Development TLS enabled, trust", ca.CertFile)
+	return server.CertPair{CertFile: certFile, KeyFile: keyFile}, nil
+}
+
+// restart hands the listener to a new process and reports whether this one should drain and exit
+func restart(srv *server.Server) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), restartTimeout)
+	defer cancel()
+	process, err := srv.Restart(ctx)
+	if err != nil {
+		log.Printf("Restart failed, still serving: %v", err)
+		return false
 	}
+	log.Printf("Handed listener to pid %d, draining", process.Pid)
+	return true
+}
 
+func successHandler(w *response.Writer, req *request.Request) {
 	contentType := "text/html"
 	w.WriteStatusLine(response.StatusOK)
 	body := `<html>
@@ -89,25 +168,60 @@ func handler(w response.Writer, req *request.Request) {
     <p>Your request was an absolute banger.</p>
   </body>
 </html>`
-	w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(body)), response.NewContentType(contentType), response.NewConnection("")))
+	w.WriteHeaders(response.NewResponseHeaders(response.NewContentType(contentType)))
 	w.WriteBody([]byte(body))
 }
 
-func main() {
-	server, err := server.Serve(port, handler)
+// httpbinHandler proxies to httpbin.org as a chunked body, with a checksum in the trailers
+func httpbinHandler(w *response.Writer, req *request.Request) {
+	contentType := "text/html"
+	res, err := http.Get("https://httpbin.org/" + req.PathValue("path"))
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		w.WriteStatusLine(response.StatusInternalServerError)
+		w.WriteHeaders(response.NewResponseHeaders(response.NewContentType(contentType), response.NewConnection("")))
+		return
 	}
-	defer server.Close()
-	log.Println("Server started on port", port)
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	log.Println("Server gracefully stopped")
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.NewResponseHeaders(response.NewContentType(contentType), response.NewTransferEncoding("chunked"), response.NewTrailer([]string{"X-Content-SHA256", "X-Content-Length"})))
+
+	fullBody := make([]byte, 0)
+	buffer := make([]byte, 1024)
+	defer res.Body.Close()
+	for {
+		n, err := res.Body.Read(buffer)
+		if n > 0 {
+			w.WriteChunkedBody(buffer[:n])
+			w.Flush()
+			fullBody = append(fullBody, buffer[:n]...)
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			if errReset := w.ResetBuffer(); errReset != nil {
+				// part of the body is already out. aborting closes the connection without the
+				// last chunk, so the client can tell the body is incomplete
+				w.Abort()
+				return
+			}
+			w.WriteStatusLine(response.StatusInternalServerError)
+			w.WriteHeaders(response.NewResponseHeaders(response.NewContentType(contentType), response.NewConnection("")))
+			return
+		}
+	}
+
+	w.WriteChunkedBodyDone()
+	sha256 := fmt.Sprintf("%x", sha256.Sum256(fullBody))
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-SHA256", sha256)
+	trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
+	w.WriteTrailers(trailers)
 }
 
-func badRequestHandler(w response.Writer, req *request.Request) {
+func badRequestHandler(w *response.Writer, req *request.Request) {
 	contentType := "text/html"
 	w.WriteStatusLine(response.StatusBadRequest)
 	body := `<html>
@@ -119,11 +233,11 @@ func badRequestHandler(w response.Writer, req *request.Request) {
     <p>Your request honestly kinda sucked.</p>
   </body>
 </html>`
-	w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(body)), response.NewContentType(contentType), response.NewConnection("")))
+	w.WriteHeaders(response.NewResponseHeaders(response.NewContentType(contentType)))
 	w.WriteBody([]byte(body))
 }
 
-func internalServerErrorHandler(w response.Writer, req *request.Request) {
+func internalServerErrorHandler(w *response.Writer, req *request.Request) {
 	contentType := "text/html"
 	body := `<html>
   <head>
@@ -135,14 +249,14 @@ func internalServerErrorHandler(w response.Writer, req *request.Request) {
   </body>
 </html>`
 	w.WriteStatusLine(response.StatusInternalServerError)
-	w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(body)), response.NewContentType(contentType), response.NewConnection("")))
+	w.WriteHeaders(response.NewResponseHeaders(response.NewContentType(contentType)))
 	w.WriteBody([]byte(body))
 }
 
-func videoHandler(w response.Writer, req *request.Request) {
+func videoHandler(w *response.Writer, req *request.Request) {
 	contentType := "video/mp4"
 	w.WriteStatusLine(response.StatusOK)
 	data, _ := os.ReadFile("asset/vim.mp4")
-	w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(data)), response.NewContentType(contentType), response.NewConnection("")))
+	w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(data)), response.NewContentType(contentType)))
 	w.WriteBody(data)
 }
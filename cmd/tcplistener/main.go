@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"strings"
+	"tcpgo/internal/headers"
 	"tcpgo/internal/request"
 )
 
@@ -45,11 +46,11 @@ func printRequestLines(request request.RequestLine) {
 	fmt.Printf("Request line:\n- Method: %s\n- Target: %s\n- Version: %s", request.Method, request.RequestTarget, request.HttpVersion)
 }
 
-func printHeaders(headers map[string]string) {
+func printHeaders(headers *headers.Headers) {
 	fmt.Println("")
 	strToPrint := "Headers:\n"
-	for key, value := range headers {
-		if key == "user-agent" && strings.HasPrefix(value, "curl/") {
+	for key, value := range headers.All() {
+		if strings.EqualFold(key, "user-agent") && strings.HasPrefix(value, "curl/") {
 			// normalize curl user-agent for testing
 			strToPrint += fmt.Sprintf("- %s: %s\n", key, "curl")
 			continue
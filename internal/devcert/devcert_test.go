@@ -0,0 +1,44 @@
+package devcert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+
+	// TEST: CA is created once and loaded afterwards
+	ca, err := LoadOrCreateCA(dir)
+	require.NoError(t, err)
+	assert.True(t, ca.Cert.IsCA)
+	again, err := LoadOrCreateCA(dir)
+	require.NoError(t, err)
+	assert.Equal(t, ca.Cert.Raw, again.Cert.Raw)
+
+	// TEST: Leaf is valid for names and IPs and chains up to the CA
+	certFile, keyFile, err := again.WriteLeaf(dir, "leaf", []string{"example.test", "127.0.0.1"})
+	require.NoError(t, err)
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.test"}, pair.Leaf.DNSNames)
+	assert.True(t, pair.Leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	for _, host := range []string{"example.test", "127.0.0.1"} {
+		_, err = pair.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+		require.NoError(t, err)
+	}
+	_, err = pair.Leaf.Verify(x509.VerifyOptions{DNSName: "other.test", Roots: roots})
+	require.Error(t, err)
+
+	// TEST: No hosts
+	_, _, err = ca.WriteLeaf(dir, "empty", nil)
+	require.Error(t, err)
+}
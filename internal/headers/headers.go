@@ -3,15 +3,27 @@ package headers
 import (
 	"bytes"
 	"errors"
+	"iter"
 	"regexp"
 	"strings"
 )
 
-type Headers map[string]string
+// Headers is an ordered list of header fields. names keep the casing they were
+// added with and are written out in insertion order, lookups ignore case.
+// a field may appear several times, e.g. Set-Cookie. the zero value is ready to use
+// and, like a nil map, a nil *Headers can be read but not written
+type Headers struct {
+	fields []Field
+}
+
+type Field struct {
+	Name  string
+	Value string
+}
 
 const CRLF = "\r\n"
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
 	if isContainsCRLF := bytes.Contains(data, []byte(CRLF)); !isContainsCRLF {
 		// Not enough data to parse headers
 		return 0, false, nil
@@ -43,25 +55,108 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	}
 
 	headerValue := string(bytes.TrimSpace(headerParts[1]))
-	h.Set(strings.ToLower(headerName), headerValue)
+	h.Add(headerName, headerValue)
 
 	return len(part) + len(CRLF), false, nil
 }
 
-func NewHeaders() Headers {
-	return map[string]string{}
+func NewHeaders() *Headers {
+	return &Headers{}
+}
+
+// Add appends a field, keeping any existing ones with the same name
+func (h *Headers) Add(key, value string) {
+	h.fields = append(h.fields, Field{Name: key, Value: value})
+}
+
+// Set replaces every field named key with a single one. it keeps the position
+// of the first existing field, or goes last when there was none
+func (h *Headers) Set(key, value string) {
+	i := h.index(key)
+	if i < 0 {
+		h.Add(key, value)
+		return
+	}
+	h.fields[i] = Field{Name: key, Value: value}
+	h.fields = append(h.fields[:i+1], deleteFields(h.fields[i+1:], key)...)
+}
+
+// Get returns the values of every field named key joined with ", ",
+// which is how a recipient may combine repeated fields
+func (h *Headers) Get(key string) (value string, exists bool) {
+	values := h.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return strings.Join(values, ", "), true
 }
 
-func (h Headers) Set(key, value string) {
-	if h[key] != "" {
-		value = h[key] + ", " + value
+// Values returns the value of every field named key, in order
+func (h *Headers) Values(key string) []string {
+	if h == nil {
+		return nil
 	}
-	h[key] = value
+	var values []string
+	for _, field := range h.fields {
+		if strings.EqualFold(field.Name, key) {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// Del removes every field named key
+func (h *Headers) Del(key string) {
+	h.fields = deleteFields(h.fields, key)
 }
 
-func (h Headers) Get(key string) (value string, exists bool) {
-	v, exists := h[key]
-	return v, exists
+// Has reports whether a field named key exists
+func (h *Headers) Has(key string) bool {
+	return h.index(key) >= 0
+}
+
+// Len is the number of fields, repeated ones counted separately
+func (h *Headers) Len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.fields)
+}
+
+// All yields every field in order with the name as it was added
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		if h == nil {
+			return
+		}
+		for _, field := range h.fields {
+			if !yield(field.Name, field.Value) {
+				return
+			}
+		}
+	}
+}
+
+func (h *Headers) index(key string) int {
+	if h == nil {
+		return -1
+	}
+	for i, field := range h.fields {
+		if strings.EqualFold(field.Name, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func deleteFields(fields []Field, key string) []Field {
+	kept := fields[:0]
+	for _, field := range fields {
+		if !strings.EqualFold(field.Name, key) {
+			kept = append(kept, field)
+		}
+	}
+	return kept
 }
 
 func containsOnlyAllowCharacters(data string) bool {
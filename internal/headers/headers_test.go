@@ -7,6 +7,11 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func get(h *Headers, key string) string {
+	value, _ := h.Get(key)
+	return value
+}
+
 func TestHeadersParse(t *testing.T) {
 	// TEST: Valid single header
 	headers := NewHeaders()
@@ -14,7 +19,7 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -32,7 +37,7 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
 	assert.Equal(t, 33, n)
 	assert.False(t, done)
 
@@ -48,13 +53,14 @@ func TestHeadersParse(t *testing.T) {
 	// more tests
 
 	// Test: Valid 2 headers with existing headers
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = NewHeaders()
+	headers.Set("host", "localhost:42069")
 	data = []byte("User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(headers, "user-agent"))
 	assert.Equal(t, 25, n)
 	assert.False(t, done)
 
@@ -64,7 +70,7 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Empty(t, headers)
+	assert.Zero(t, headers.Len())
 	assert.Equal(t, 2, n)
 	assert.True(t, done)
 
@@ -82,7 +88,7 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069, example.com", headers["host"])
+	assert.Equal(t, "localhost:42069, example.com", get(headers, "host"))
 	assert.Equal(t, 19, n)
 	assert.False(t, done)
 
@@ -94,3 +100,53 @@ func TestHeadersParse(t *testing.T) {
 	assert.Nil(t, err)
 	assert.False(t, done)
 }
+
+func TestHeadersFields(t *testing.T) {
+	// TEST: Parse keeps the casing and order of the fields
+	h := NewHeaders()
+	data := []byte("Host: example.com\r\nSet-Cookie: a=1\r\nX-Custom: yes\r\nset-cookie: b=2\r\n\r\n")
+	for {
+		n, done, err := h.Parse(data)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+	fields := []string{}
+	for key, value := range h.All() {
+		fields = append(fields, key+": "+value)
+	}
+	assert.Equal(t, []string{"Host: example.com", "Set-Cookie: a=1", "X-Custom: yes", "set-cookie: b=2"}, fields)
+
+	// TEST: Lookup ignores case, repeated fields stay separate
+	assert.Equal(t, []string{"a=1", "b=2"}, h.Values("SET-COOKIE"))
+	assert.Equal(t, "a=1, b=2", get(h, "Set-Cookie"))
+	assert.True(t, h.Has("x-custom"))
+
+	// TEST: Set replaces every field in place of the first one
+	h.Set("SET-COOKIE", "c=3")
+	assert.Equal(t, []string{"c=3"}, h.Values("set-cookie"))
+	assert.Equal(t, 3, h.Len())
+	names := []string{}
+	for key := range h.All() {
+		names = append(names, key)
+	}
+	assert.Equal(t, []string{"Host", "SET-COOKIE", "X-Custom"}, names)
+
+	// TEST: Add appends, Del removes every field with the name
+	h.Add("Set-Cookie", "d=4")
+	assert.Equal(t, []string{"c=3", "d=4"}, h.Values("Set-Cookie"))
+	h.Del("set-cookie")
+	assert.False(t, h.Has("Set-Cookie"))
+	assert.Equal(t, 2, h.Len())
+	_, exists := h.Get("Set-Cookie")
+	assert.False(t, exists)
+
+	// TEST: A nil Headers reads as empty
+	var empty *Headers
+	assert.Equal(t, 0, empty.Len())
+	assert.Nil(t, empty.Values("Host"))
+	_, exists = empty.Get("Host")
+	assert.False(t, exists)
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"tcpgo/internal/headers"
+	"tcpgo/internal/request"
+	"tcpgo/internal/response"
+	"tcpgo/internal/server"
+	"time"
+)
+
+const RequestIDHeader = "X-Request-Id"
+
+// Logging logs one line per request with the method, target, status and duration
+func Logging(logger *log.Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+			status := w.Status()
+			if status == 0 {
+				// the server fills in a 200 when the handler writes nothing
+				status = response.StatusOK
+			}
+			logger.Printf("%s %s %d %s\n", req.RequestLine.Method, req.RequestLine.RequestTarget, status, time.Since(start))
+		}
+	}
+}
+
+// Recovery turns a panicking handler into a 500 and logs the stack trace.
+// when part of the response already reached the client the response is aborted instead
+func Recovery(logger *log.Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+				logger.Printf("panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, recovered, debug.Stack())
+				if err := w.ResetBuffer(); err != nil {
+					w.Abort()
+					return
+				}
+				body := "Internal Server Error"
+				w.WriteStatusLine(response.StatusInternalServerError)
+				w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(body)), response.NewContentType("text/plain")))
+				w.WriteBody([]byte(body))
+			}()
+			next(w, req)
+		}
+	}
+}
+
+// RequestID makes sure every request carries an X-Request-Id, keeping the client's one
+// when it sent one, and echoes it on the response
+func RequestID() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			id, ok := req.Headers.Get("x-request-id")
+			if !ok || id == "" {
+				id = newRequestID()
+				if req.Headers == nil {
+					req.Headers = headers.NewHeaders()
+				}
+				req.Headers.Set(RequestIDHeader, id)
+			}
+			w.OnHeaders(func(h *headers.Headers) {
+				if !h.Has(RequestIDHeader) {
+					h.Set(RequestIDHeader, id)
+				}
+			})
+			next(w, req)
+		}
+	}
+}
+
+// Timing reports how long the handler took until it wrote its headers in a Server-Timing header
+func Timing() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			w.OnHeaders(func(h *headers.Headers) {
+				h.Add("Server-Timing", fmt.Sprintf("app;dur=%.3f", float64(time.Since(start).Microseconds())/1000))
+			})
+			next(w, req)
+		}
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
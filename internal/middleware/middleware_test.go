@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"bytes"
+	"log"
+	"tcpgo/internal/headers"
+	"tcpgo/internal/request"
+	"tcpgo/internal/response"
+	"tcpgo/internal/server"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// run serves req with h the way the server does and returns the raw response
+func run(h server.Handler, req *request.Request) (string, *response.Writer) {
+	var out bytes.Buffer
+	w := response.NewWriter(&out)
+	h(w, req)
+	w.Finish()
+	w.Flush()
+	return out.String(), w
+}
+
+func newRequest(target string) *request.Request {
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+}
+
+func hello(w *response.Writer, req *request.Request) {
+	body := "hello"
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(body))))
+	w.WriteBody([]byte(body))
+}
+
+func TestMiddleware(t *testing.T) {
+	// TEST: Chain runs the first middleware outermost
+	order := []string{}
+	mark := func(name string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(w *response.Writer, req *request.Request) {
+				order = append(order, name)
+				next(w, req)
+			}
+		}
+	}
+	run(server.Chain(hello, mark("a"), mark("b")), newRequest("/"))
+	assert.Equal(t, []string{"a", "b"}, order)
+
+	// TEST: Logging writes method, target and status
+	var logs bytes.Buffer
+	logger := log.New(&logs, "", 0)
+	run(server.Chain(hello, Logging(logger)), newRequest("/logged"))
+	assert.Contains(t, logs.String(), "GET /logged 200 ")
+
+	// TEST: Recovery answers 500 when nothing was flushed
+	logs.Reset()
+	panics := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		panic("boom")
+	}
+	res, w := run(server.Chain(panics, Recovery(logger)), newRequest("/panic"))
+	assert.Contains(t, res, "HTTP/1.1 500 Internal Server Error\r\n")
+	assert.Contains(t, logs.String(), "panic serving GET /panic: boom")
+	assert.Contains(t, logs.String(), "goroutine")
+
+	// TEST: Recovery aborts a response that already reached the client
+	flushedPanic := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.NewResponseHeaders(response.NewTransferEncoding("chunked")))
+		w.WriteChunkedBody([]byte("partial"))
+		w.Flush()
+		panic("boom")
+	}
+	w = response.NewWriter(&bytes.Buffer{})
+	w.KeepAlive = true
+	server.Chain(flushedPanic, Recovery(logger))(w, newRequest("/"))
+	require.NoError(t, w.Finish())
+	assert.False(t, w.KeepAlive)
+	_, err := w.WriteChunkedBody([]byte("more"))
+	assert.Error(t, err)
+
+	// TEST: RequestID generates an id and echoes it
+	req := newRequest("/")
+	res, _ = run(server.Chain(hello, RequestID()), req)
+	id, ok := req.Headers.Get("x-request-id")
+	require.True(t, ok)
+	assert.Len(t, id, 32)
+	assert.Contains(t, res, "X-Request-Id: "+id+"\r\n")
+
+	// TEST: RequestID keeps the client's id
+	req = newRequest("/")
+	req.Headers.Set("X-Request-Id", "abc-123")
+	res, _ = run(server.Chain(hello, RequestID()), req)
+	assert.Contains(t, res, "X-Request-Id: abc-123\r\n")
+
+	// TEST: Timing adds Server-Timing, also to headers the server fills in
+	res, _ = run(server.Chain(func(w *response.Writer, req *request.Request) {}, Timing()), newRequest("/"))
+	assert.Regexp(t, `Server-Timing: app;dur=[0-9.]+\r\n`, res)
+}
@@ -0,0 +1,67 @@
+package request
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrBodyClosed = errors.New("read on closed body")
+
+// bodyReader decodes the body of a streamed request straight off the Reader,
+// so only what has been read from the connection so far is held in memory
+type bodyReader struct {
+	request *Request
+	reader  *Reader
+	closed  bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyClosed
+	}
+
+	for len(b.request.pendingBody) == 0 {
+		if b.request.state == requestStateDone {
+			return 0, io.EOF
+		}
+
+		if err := b.reader.parse(b.request); err != nil {
+			return 0, err
+		}
+		if len(b.request.pendingBody) > 0 || b.request.state == requestStateDone {
+			continue
+		}
+
+		errRead := b.reader.fill()
+		if errRead != nil {
+			if !errors.Is(errRead, io.EOF) {
+				return 0, errRead
+			}
+			if err := b.reader.parse(b.request); err != nil {
+				return 0, err
+			}
+			if len(b.request.pendingBody) == 0 && b.request.state != requestStateDone {
+				// the stream ended in the middle of the body
+				return 0, io.ErrUnexpectedEOF
+			}
+		}
+	}
+
+	n := copy(p, b.request.pendingBody)
+	b.request.pendingBody = b.request.pendingBody[n:]
+	if len(b.request.pendingBody) == 0 {
+		b.request.pendingBody = nil
+	}
+	return n, nil
+}
+
+// Close discards whatever is left of the body so the next request on the
+// stream can be read
+func (b *bodyReader) Close() error {
+	if b.closed {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, b)
+	b.closed = true
+	return err
+}
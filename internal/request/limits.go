@@ -0,0 +1,50 @@
+package request
+
+import "errors"
+
+var (
+	ErrRequestLineTooLong = errors.New("request line too long")
+	ErrHeadersTooLarge    = errors.New("request header fields too large")
+	ErrBodyTooLarge       = errors.New("request body too large")
+)
+
+// Limits bounds how much of a request a Reader accepts, so a single client
+// can't make the server allocate arbitrary memory. zero means no limit
+type Limits struct {
+	MaxRequestLineBytes int
+	// MaxHeaderBytes and MaxHeaderCount also cover trailer fields of chunked bodies
+	MaxHeaderBytes int
+	MaxHeaderCount int
+	MaxBodyBytes   int
+}
+
+var DefaultLimits = Limits{
+	MaxRequestLineBytes: 8 << 10,
+	MaxHeaderBytes:      64 << 10,
+	MaxHeaderCount:      100,
+	MaxBodyBytes:        10 << 20,
+}
+
+func (l Limits) checkRequestLine(n int) error {
+	if l.MaxRequestLineBytes > 0 && n > l.MaxRequestLineBytes {
+		return ErrRequestLineTooLong
+	}
+	return nil
+}
+
+func (l Limits) checkHeaders(n, count int) error {
+	if l.MaxHeaderBytes > 0 && n > l.MaxHeaderBytes {
+		return ErrHeadersTooLarge
+	}
+	if l.MaxHeaderCount > 0 && count > l.MaxHeaderCount {
+		return ErrHeadersTooLarge
+	}
+	return nil
+}
+
+func (l Limits) checkBody(n int) error {
+	if l.MaxBodyBytes > 0 && n > l.MaxBodyBytes {
+		return ErrBodyTooLarge
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package request
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+)
+
+// PeerIdentity is the client certificate of a mutual TLS connection,
+// only set once it was verified against the server's client CAs
+type PeerIdentity struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	EmailAddresses []string
+	Certificate    *x509.Certificate
+	// VerifiedChains are the chains from the client certificate up to a trusted CA
+	VerifiedChains [][]*x509.Certificate
+}
+
+// NewPeerIdentity builds the identity from verified chains, leaf first.
+// it returns nil when there is nothing verified
+func NewPeerIdentity(verifiedChains [][]*x509.Certificate) *PeerIdentity {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return nil
+	}
+	leaf := verifiedChains[0][0]
+	return &PeerIdentity{
+		Subject:        leaf.Subject,
+		DNSNames:       leaf.DNSNames,
+		IPAddresses:    leaf.IPAddresses,
+		URIs:           leaf.URIs,
+		EmailAddresses: leaf.EmailAddresses,
+		Certificate:    leaf,
+		VerifiedChains: verifiedChains,
+	}
+}
@@ -13,71 +13,224 @@ import (
 const BUFFER_SIZE = 8
 const CRLF = "\r\n"
 
+// ErrUnsupportedVersion is a well-formed request line with an HTTP major version other than 1
+var ErrUnsupportedVersion = errors.New("unsupported HTTP version")
+
+// ErrUnsupportedTransferEncoding is a Transfer-Encoding other than a single "chunked".
+// other codings would hand the handler a body it can't tell is still encoded
+var ErrUnsupportedTransferEncoding = errors.New("unsupported transfer-encoding")
+
+// maxChunkSizeLineBytes bounds a chunk-size line including its extensions
+const maxChunkSizeLineBytes = 4096
+
 const (
 	requestStateInitialized = iota
 	requestStateParsingHeaders
 	requestStateParsingBody
+	requestStateParsingChunkSize
+	requestStateParsingChunkData
+	requestStateParsingChunkDataEnd
+	requestStateParsingTrailers
 	requestStateDone
 )
 
 type Request struct {
-	RequestLine    RequestLine
-	Headers        headers.Headers
-	Body           []byte
+	RequestLine RequestLine
+	Headers     *headers.Headers
+	Body        []byte
+	// BodyReader streams the body when the request was read with ReadRequestStream.
+	// Body stays empty in that case
+	BodyReader io.ReadCloser
+	// Trailers holds the trailer fields sent after a chunked body.
+	// when streaming they are only complete once BodyReader returns io.EOF
+	Trailers *headers.Headers
+	// Peer is the verified client certificate when the connection uses mutual TLS
+	Peer *PeerIdentity
+	// PathParams holds the named segments of the route pattern that matched, see PathValue
+	PathParams     map[string]string
 	state          int
+	limits         Limits
+	headerBytes    int
+	headerCount    int
+	streaming      bool
+	pendingBody    []byte
 	bodyLengthRead int
+	chunkRemaining int
 }
 
 type RequestLine struct {
-	HttpVersion   string
+	HttpVersion string
+	// RequestTarget is the target as sent, Target is its parsed form
 	RequestTarget string
+	Target        Target
 	Method        string
 }
 
+// Reader parses successive requests from a single stream, such as a keep-alive connection.
+// bytes read past the end of one request are kept and parsed as the start of the next one
+type Reader struct {
+	// Limits applies to every request read after it is set. the zero value accepts anything
+	Limits Limits
+	// lenient accepts a request cut short by the end of the stream, see RequestFromReader
+	lenient       bool
+	reader        io.Reader
+	buf           []byte
+	readerToIndex int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, BUFFER_SIZE),
+	}
+}
+
+// RequestFromReader parses a single request and expects nothing else on the stream.
+// the end of the stream ends the request, even when it stops short
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, BUFFER_SIZE)
-	request := &Request{
+	requestReader := NewReader(reader)
+	requestReader.lenient = true
+	request, err := requestReader.ReadRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, exists := request.Headers.Get("content-length"); exists && requestReader.Buffered() > 0 {
+		return nil, fmt.Errorf("Content-Length too large")
+	}
+
+	return request, nil
+}
+
+// ReadRequest parses the next request from the stream, including its whole body.
+// it returns io.EOF when the stream ends before any byte of a new request arrives,
+// and io.ErrUnexpectedEOF when it ends in the middle of one
+func (rr *Reader) ReadRequest() (*Request, error) {
+	request := newRequest(rr.Limits)
+	if err := rr.readUntil(request, requestStateDone); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// ReadRequestStream parses the request line and headers of the next request and
+// returns without waiting for the body, which is read through Request.BodyReader.
+// the body must be read to the end or closed before the next request is read
+func (rr *Reader) ReadRequestStream() (*Request, error) {
+	request := newRequest(rr.Limits)
+	request.streaming = true
+	if err := rr.readUntil(request, requestStateParsingBody); err != nil {
+		return nil, err
+	}
+	request.BodyReader = &bodyReader{
+		request: request,
+		reader:  rr,
+	}
+	return request, nil
+}
+
+// Wait blocks until bytes of the next request are available.
+// it returns io.EOF when the stream ends first
+func (rr *Reader) Wait() error {
+	for rr.readerToIndex == 0 {
+		if err := rr.fill(); err != nil {
+			if rr.readerToIndex > 0 {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadBody reads the rest of a streamed body into Body, turning the request into
+// one read with ReadRequest
+func (r *Request) ReadBody() error {
+	if r.BodyReader == nil {
+		return nil
+	}
+	body, err := io.ReadAll(r.BodyReader)
+	if err != nil {
+		return err
+	}
+	r.Body = append(r.Body, body...)
+	r.BodyReader = nil
+	return nil
+}
+
+// Buffered returns the number of bytes already read from the stream that
+// belong to the next request
+func (rr *Reader) Buffered() int {
+	return rr.readerToIndex
+}
+
+func newRequest(limits Limits) *Request {
+	return &Request{
 		state:       requestStateInitialized,
 		RequestLine: RequestLine{},
-		Headers:     headers.Headers{},
+		Headers:     headers.NewHeaders(),
+		limits:      limits,
 	}
+}
 
-	readerToIndex := 0
-	for request.state != requestStateDone {
-		// stretch the buffer if needed
-		if readerToIndex >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+// readUntil parses and reads from the stream until the request reaches state
+func (rr *Reader) readUntil(request *Request, state int) error {
+	for {
+		// leftover bytes from the previous request are parsed before reading more
+		if err := rr.parse(request); err != nil {
+			return err
+		}
+		if request.state >= state {
+			return nil
 		}
 
-		numOfBytesRead, errRead := reader.Read(buf[readerToIndex:])
-
+		errRead := rr.fill()
 		if errRead != nil {
 			if errors.Is(errRead, io.EOF) {
+				if request.state == requestStateInitialized && rr.readerToIndex == 0 {
+					// nothing was sent at all
+					return io.EOF
+				}
+				if err := rr.parse(request); err != nil {
+					return err
+				}
+				if request.state >= state {
+					return nil
+				}
+				if !rr.lenient {
+					return io.ErrUnexpectedEOF
+				}
 				request.state = requestStateDone
-				break
+				return nil
 			}
-			return nil, errRead
+			return errRead
 		}
+	}
+}
 
-		readerToIndex += numOfBytesRead
+// fill reads from the stream once, appending to the buffer
+func (rr *Reader) fill() error {
+	// stretch the buffer if needed
+	if rr.readerToIndex >= len(rr.buf) {
+		newBuf := make([]byte, len(rr.buf)*2)
+		copy(newBuf, rr.buf)
+		rr.buf = newBuf
+	}
 
-		numBytesParsed, errParse := request.parse(buf[:readerToIndex])
-		if errParse != nil {
-			return nil, errParse
-		}
+	numOfBytesRead, errRead := rr.reader.Read(rr.buf[rr.readerToIndex:])
+	rr.readerToIndex += numOfBytesRead
+	return errRead
+}
 
-		copy(buf, buf[numBytesParsed:])
-		readerToIndex -= numBytesParsed
+func (rr *Reader) parse(request *Request) error {
+	numBytesParsed, errParse := request.parse(rr.buf[:rr.readerToIndex])
+	if errParse != nil {
+		return errParse
 	}
 
-	return &Request{
-		RequestLine: request.RequestLine,
-		Headers:     request.Headers,
-		Body:        request.Body,
-		state:       request.state,
-	}, nil
+	copy(rr.buf, rr.buf[numBytesParsed:rr.readerToIndex])
+	rr.readerToIndex -= numBytesParsed
+	return nil
 }
 
 func parseRequestLine(buf []byte) (*RequestLine, int, error) {
@@ -104,29 +257,53 @@ func requestLineFromString(str string) (*RequestLine, error) {
 		return &RequestLine{}, fmt.Errorf("error parsing request line")
 	}
 
-	if parts[0] != "GET" && parts[0] != "POST" && parts[0] != "PUT" && parts[0] != "DELETE" && parts[0] != "HEAD" && parts[0] != "OPTIONS" && parts[0] != "PATCH" {
+	if parts[0] != "GET" && parts[0] != "POST" && parts[0] != "PUT" && parts[0] != "DELETE" && parts[0] != "HEAD" && parts[0] != "OPTIONS" && parts[0] != "PATCH" && parts[0] != "CONNECT" {
 		return &RequestLine{}, fmt.Errorf("invalid method in request line")
 	}
 
-	if parts[2] != "HTTP/1.1" {
+	version, ok := strings.CutPrefix(parts[2], "HTTP/")
+	if !ok || len(version) != 3 || !isDigit(version[0]) || version[1] != '.' || !isDigit(version[2]) {
 		return &RequestLine{}, fmt.Errorf("invalid HTTP version in request line")
 	}
+	if version[0] != '1' {
+		return &RequestLine{}, fmt.Errorf("%w: HTTP/%s", ErrUnsupportedVersion, version)
+	}
+
+	target, err := ParseTarget(parts[0], parts[1])
+	if err != nil {
+		return &RequestLine{}, err
+	}
 
 	return &RequestLine{
 		Method:        parts[0],
 		RequestTarget: parts[1],
-		HttpVersion:   strings.TrimPrefix(parts[2], "HTTP/"),
+		Target:        *target,
+		HttpVersion:   version,
 	}, nil
 }
 
+// ProtoAtLeast reports whether the request was sent with HTTP/major.minor or later
+func (rl RequestLine) ProtoAtLeast(major, minor int) bool {
+	if len(rl.HttpVersion) != 3 {
+		return false
+	}
+	gotMajor, gotMinor := int(rl.HttpVersion[0]-'0'), int(rl.HttpVersion[2]-'0')
+	return gotMajor > major || gotMajor == major && gotMinor >= minor
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
 	for r.state != requestStateDone {
+		state := r.state
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
 			return 0, err
 		}
-		if n == 0 {
+		if n == 0 && r.state == state {
 			// need more data
 			break
 		}
@@ -145,9 +322,15 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return 0, err
 		}
 		if n == 0 {
+			if err := r.limits.checkRequestLine(len(data)); err != nil {
+				return 0, err
+			}
 			// need more data
 			return 0, nil
 		}
+		if err := r.limits.checkRequestLine(n - len(CRLF)); err != nil {
+			return 0, err
+		}
 		r.RequestLine = *requestLine
 		r.state = requestStateParsingHeaders
 		return n, nil
@@ -159,6 +342,9 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if err != nil {
 			return 0, err
 		}
+		if err := r.countHeaderBytes(n, done, len(data)); err != nil {
+			return 0, err
+		}
 		if n == 0 && !done {
 			// need more data
 			return 0, nil
@@ -168,7 +354,19 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		}
 		return n, nil
 	case requestStateParsingBody:
+		transferEncoding, isChunked := r.Headers.Get("transfer-encoding")
 		contentLengthStr, exists := r.Headers.Get("content-length")
+		if isChunked {
+			if exists {
+				// ambiguous framing, see RFC 9112 section 6.3
+				return 0, fmt.Errorf("both transfer-encoding and content-length are set")
+			}
+			if !strings.EqualFold(strings.TrimSpace(transferEncoding), "chunked") {
+				return 0, fmt.Errorf("%w: %q", ErrUnsupportedTransferEncoding, transferEncoding)
+			}
+			r.state = requestStateParsingChunkSize
+			return 0, nil
+		}
 		if !exists {
 			// no body
 			r.state = requestStateDone
@@ -178,16 +376,121 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if err != nil {
 			return 0, fmt.Errorf("invalid content-length header")
 		}
-		r.Body = append(r.Body, data...)
-		r.bodyLengthRead += len(data)
-		if r.bodyLengthRead > contentLengthInt {
-			return 0, fmt.Errorf("Content-Length too large")
+		if contentLengthInt < 0 {
+			return 0, fmt.Errorf("invalid content-length header")
 		}
+		if err := r.limits.checkBody(contentLengthInt); err != nil {
+			return 0, err
+		}
+		// anything past Content-Length belongs to the next request
+		n := min(len(data), contentLengthInt-r.bodyLengthRead)
+		r.appendBody(data[:n])
 		if r.bodyLengthRead == contentLengthInt {
 			r.state = requestStateDone
 		}
-		return len(data), nil
+		return n, nil
+	case requestStateParsingChunkSize:
+		idx := bytes.Index(data, []byte(CRLF))
+		if idx == -1 {
+			if len(data) > maxChunkSizeLineBytes {
+				return 0, fmt.Errorf("invalid chunk size: line too long")
+			}
+			// need more data
+			return 0, nil
+		}
+		size, err := parseChunkSize(data[:idx])
+		if err != nil {
+			return 0, err
+		}
+		if err := r.limits.checkBody(r.bodyLengthRead + size); err != nil {
+			return 0, err
+		}
+		r.chunkRemaining = size
+		if size == 0 {
+			// last-chunk, only trailer fields are left
+			r.state = requestStateParsingTrailers
+		} else {
+			r.state = requestStateParsingChunkData
+		}
+		return idx + len(CRLF), nil
+	case requestStateParsingChunkData:
+		n := min(len(data), r.chunkRemaining)
+		r.appendBody(data[:n])
+		r.chunkRemaining -= n
+		if r.chunkRemaining == 0 {
+			r.state = requestStateParsingChunkDataEnd
+		}
+		return n, nil
+	case requestStateParsingChunkDataEnd:
+		if len(data) < len(CRLF) {
+			// need more data
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, []byte(CRLF)) {
+			return 0, fmt.Errorf("invalid chunk: missing CRLF after chunk data")
+		}
+		r.state = requestStateParsingChunkSize
+		return len(CRLF), nil
+	case requestStateParsingTrailers:
+		if r.Trailers == nil {
+			r.Trailers = headers.NewHeaders()
+		}
+		n, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		if err := r.countHeaderBytes(n, done, len(data)); err != nil {
+			return 0, err
+		}
+		if done {
+			r.state = requestStateDone
+		}
+		return n, nil
 	default:
 		return 0, fmt.Errorf("unknown state")
 	}
 }
+
+// countHeaderBytes tracks the size of header and trailer sections against the limits.
+// n is what a Headers.Parse call consumed out of available bytes
+func (r *Request) countHeaderBytes(n int, done bool, available int) error {
+	if n == 0 && !done {
+		// an unfinished field line, make sure it isn't already too long
+		return r.limits.checkHeaders(r.headerBytes+available, r.headerCount)
+	}
+	r.headerBytes += n
+	if !done {
+		r.headerCount++
+	}
+	return r.limits.checkHeaders(r.headerBytes, r.headerCount)
+}
+
+// PathValue returns the path segment matched by {name} in the route pattern, or "" if there is none
+func (r *Request) PathValue(name string) string {
+	return r.PathParams[name]
+}
+
+// appendBody keeps decoded body bytes, either in Body or, when streaming,
+// until BodyReader hands them out
+func (r *Request) appendBody(p []byte) {
+	if r.streaming {
+		r.pendingBody = append(r.pendingBody, p...)
+	} else {
+		r.Body = append(r.Body, p...)
+	}
+	r.bodyLengthRead += len(p)
+}
+
+// parseChunkSize reads the hex size of a chunk-size line, ignoring any chunk extensions
+func parseChunkSize(line []byte) (int, error) {
+	sizePart, _, _ := bytes.Cut(line, []byte(";"))
+	sizePart = bytes.TrimSpace(sizePart)
+	if len(sizePart) == 0 {
+		return 0, fmt.Errorf("invalid chunk size")
+	}
+	size, err := strconv.ParseInt(string(sizePart), 16, 32)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid chunk size")
+	}
+	return int(size), nil
+}
@@ -2,6 +2,8 @@ package request
 
 import (
 	"io"
+	"strings"
+	"tcpgo/internal/headers"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -28,6 +30,11 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+func get(h *headers.Headers, key string) string {
+	value, _ := h.Get(key)
+	return value
+}
+
 func TestRequestLineParse(t *testing.T) {
 	// TEST: Good GET Request line
 	reader := &chunkReader{
@@ -78,7 +85,27 @@ func TestRequestLineParse(t *testing.T) {
 		numBytesPerRead: 3,
 	}
 	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	// TEST: HTTP/1.0 request line
+	reader = &chunkReader{
+		data:            "GET /coffee HTTP/1.0\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.RequestLine.ProtoAtLeast(1, 1))
+	assert.True(t, r.RequestLine.ProtoAtLeast(1, 0))
+
+	// TEST: Malformed version is not an unsupported one
+	reader = &chunkReader{
+		data:            "GET /coffee HTTP/1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
 	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUnsupportedVersion)
 
 	// TEST: Invalid number of parts in request line
 	reader = &chunkReader{
@@ -105,9 +132,9 @@ func TestRequestLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", get(r.Headers, "accept"))
 
 	// TEST: Malformed Header
 	reader = &chunkReader{
@@ -134,9 +161,9 @@ func TestRequestLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", get(r.Headers, "accept"))
 
 	// TEST: Duplicate Headers
 	reader = &chunkReader{
@@ -145,7 +172,7 @@ func TestRequestLineParse(t *testing.T) {
 	}
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
-	assert.Equal(t, "localhost:42069, duplicate", r.Headers["host"])
+	assert.Equal(t, "localhost:42069, duplicate", get(r.Headers, "host"))
 
 	// TEST: Case Insensitive Headers
 	reader = &chunkReader{
@@ -155,9 +182,9 @@ func TestRequestLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", get(r.Headers, "accept"))
 
 	//TEST: Missing End of Headers
 	reader = &chunkReader{
@@ -245,3 +272,393 @@ func TestRequestLineParse(t *testing.T) {
 	_, err = RequestFromReader(reader)
 	require.Error(t, err)
 }
+
+func TestReaderPipelining(t *testing.T) {
+	// TEST: Pipelined requests are returned in order
+	reader := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /coffee HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n" +
+			"DELETE /tea HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "POST", r.RequestLine.Method)
+	assert.Equal(t, "hello", string(r.Body))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "DELETE", r.RequestLine.Method)
+	assert.Equal(t, "/tea", r.RequestLine.RequestTarget)
+
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.EOF)
+
+	// TEST: Stream ending in the middle of the headers is not a request
+	reader = NewReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\nHost: x",
+		numBytesPerRead: 7,
+	})
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = reader.ReadRequestStream()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	reader = NewReader(&chunkReader{data: "GARBAGE", numBytesPerRead: 3})
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// TEST: Whole pipeline arrives in a single read
+	reader = NewReader(&chunkReader{
+		data:            "GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 100,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	assert.NotZero(t, reader.Buffered())
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+	assert.Equal(t, 0, reader.Buffered())
+}
+
+func TestChunkedBody(t *testing.T) {
+	// TEST: Chunked body with extensions and trailers
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"7;name=value\r\n" +
+			" world!\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, "abc123", get(r.Trailers, "x-checksum"))
+
+	// TEST: Chunked body without trailers, followed by a pipelined request
+	requestReader := NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"A\r\n" +
+			"0123456789\r\n" +
+			"0\r\n" +
+			"\r\n" +
+			"GET / HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	})
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(r.Body))
+	assert.Zero(t, r.Trailers.Len())
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+
+	// TEST: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\n" +
+			"hello\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// TEST: Chunk data longer than its size
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// TEST: Codings other than a single chunked are not implemented
+	for _, transferEncoding := range []string{"gzip, chunked", "gzip", "chunked, chunked"} {
+		reader = &chunkReader{
+			data:            "POST /upload HTTP/1.1\r\nTransfer-Encoding: " + transferEncoding + "\r\n\r\n0\r\n\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err = RequestFromReader(reader)
+		require.ErrorIs(t, err, ErrUnsupportedTransferEncoding, transferEncoding)
+	}
+
+	// TEST: Both Transfer-Encoding and Content-Length
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+}
+
+func TestReadRequestStream(t *testing.T) {
+	// TEST: Content-Length body is streamed and the next request is still parsed
+	reader := NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n" +
+			"GET / HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err := reader.ReadRequestStream()
+	require.NoError(t, err)
+	assert.Equal(t, "POST", r.RequestLine.Method)
+	assert.Empty(t, r.Body)
+	require.NotNil(t, r.BodyReader)
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+	require.NoError(t, r.BodyReader.Close())
+
+	r, err = reader.ReadRequestStream()
+	require.NoError(t, err)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+
+	// TEST: Chunked body is streamed with trailers
+	reader = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n" +
+			"6\r\n" +
+			" world\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	})
+	r, err = reader.ReadRequestStream()
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+	assert.Equal(t, "abc123", get(r.Trailers, "x-checksum"))
+
+	// TEST: Closing an unread body skips to the next request
+	reader = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 10\r\n" +
+			"\r\n" +
+			"0123456789" +
+			"GET /next HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	})
+	r, err = reader.ReadRequestStream()
+	require.NoError(t, err)
+	require.NoError(t, r.BodyReader.Close())
+	_, err = r.BodyReader.Read(make([]byte, 1))
+	require.ErrorIs(t, err, ErrBodyClosed)
+	r, err = reader.ReadRequestStream()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+
+	// TEST: Stream ends before the body is complete
+	reader = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 20\r\n" +
+			"\r\n" +
+			"partial content",
+		numBytesPerRead: 3,
+	})
+	r, err = reader.ReadRequestStream()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReaderLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineBytes: 32,
+		MaxHeaderBytes:      64,
+		MaxHeaderCount:      2,
+		MaxBodyBytes:        8,
+	}
+
+	// TEST: Request line over the limit, without CRLF yet
+	reader := NewReader(&chunkReader{
+		data:            "GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	reader.Limits = limits
+	_, err := reader.ReadRequest()
+	require.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// TEST: Request line within the limit
+	reader = NewReader(&chunkReader{
+		data:            "GET /short HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	reader.Limits = limits
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+
+	// TEST: Too many header fields
+	reader = NewReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	reader.Limits = limits
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// TEST: Header section over the byte limit
+	reader = NewReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nA: " + strings.Repeat("a", 100) + "\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	reader.Limits = limits
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// TEST: Content-Length over the body limit is rejected before reading the body
+	reader = NewReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	reader.Limits = limits
+	_, err = reader.ReadRequestStream()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// TEST: Chunked body over the body limit
+	reader = NewReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	reader.Limits = limits
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestParseTarget(t *testing.T) {
+	// TEST: Origin form with query
+	target, err := ParseTarget("GET", "/search?q=go+lang&page=2")
+	require.NoError(t, err)
+	assert.Equal(t, TargetOrigin, target.Form)
+	assert.Equal(t, "/search", target.Path)
+	assert.Equal(t, "q=go+lang&page=2", target.RawQuery)
+	assert.Equal(t, "go lang", target.Query().Get("q"))
+	assert.Equal(t, "2", target.Query().Get("page"))
+
+	// TEST: Percent-decoding keeps an encoded slash apart in RawPath
+	target, err = ParseTarget("GET", "/files/a%20b/c%2fd/%7Euser")
+	require.NoError(t, err)
+	assert.Equal(t, "/files/a b/c/d/~user", target.Path)
+	assert.Equal(t, "/files/a%20b/c%2Fd/~user", target.RawPath)
+
+	// TEST: Dot segments are removed, encoded ones too, and never climb above the root
+	for raw, path := range map[string]string{
+		"/a/b/../c":       "/a/c",
+		"/a/./b/.":        "/a/b/",
+		"/a/b/..":         "/a/",
+		"/../../etc":      "/etc",
+		"/a/%2e%2E/b":     "/b",
+		"/":               "/",
+		"/a//b":           "/a//b",
+		"/static/../..//": "//",
+	} {
+		target, err = ParseTarget("GET", raw)
+		require.NoError(t, err, raw)
+		assert.Equal(t, path, target.Path, raw)
+	}
+
+	// TEST: Absolute form for proxies
+	target, err = ParseTarget("GET", "HTTP://example.com:8080/a/../b?x=1")
+	require.NoError(t, err)
+	assert.Equal(t, TargetAbsolute, target.Form)
+	assert.Equal(t, "http", target.Scheme)
+	assert.Equal(t, "example.com:8080", target.Host)
+	assert.Equal(t, "/b", target.Path)
+	assert.Equal(t, "x=1", target.RawQuery)
+	target, err = ParseTarget("GET", "http://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "/", target.Path)
+
+	// TEST: Authority form only for CONNECT
+	target, err = ParseTarget("CONNECT", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, TargetAuthority, target.Form)
+	assert.Equal(t, "example.com:443", target.Host)
+	assert.Empty(t, target.Path)
+	_, err = ParseTarget("CONNECT", "example.com")
+	assert.ErrorIs(t, err, ErrInvalidTarget)
+	_, err = ParseTarget("CONNECT", "/path")
+	assert.ErrorIs(t, err, ErrInvalidTarget)
+	_, err = ParseTarget("GET", "example.com:443")
+	assert.ErrorIs(t, err, ErrInvalidTarget)
+
+	// TEST: Asterisk form only for OPTIONS
+	target, err = ParseTarget("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, TargetAsterisk, target.Form)
+	_, err = ParseTarget("GET", "*")
+	assert.ErrorIs(t, err, ErrInvalidTarget)
+
+	// TEST: Encoded slashes that decode into dot segments, fragments, bad escapes,
+	// userinfo and bad ports are rejected
+	for _, raw := range []string{"/..%2F..%2Fetc%2Fpasswd", "/a/.%2f..%2Fb", "/a%2F.", "/a#frag", "/a%zz", "/a%2", "http://user@example.com/", "http://example.com:80x/", "http:///a", "1http://example.com/"} {
+		_, err = ParseTarget("GET", raw)
+		assert.ErrorIs(t, err, ErrInvalidTarget, raw)
+	}
+
+	// TEST: The request line carries the parsed target
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET /a/../coffee?size=large HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "/a/../coffee?size=large", r.RequestLine.RequestTarget)
+	assert.Equal(t, "/coffee", r.RequestLine.Target.Path)
+	assert.Equal(t, "large", r.RequestLine.Target.Query().Get("size"))
+	_, err = RequestFromReader(&chunkReader{
+		data:            "GET /coffee#top HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	assert.ErrorIs(t, err, ErrInvalidTarget)
+}
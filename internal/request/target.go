@@ -0,0 +1,232 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var ErrInvalidTarget = errors.New("invalid request target")
+
+// TargetForm is one of the four request-target forms of RFC 9112 section 3.2
+type TargetForm int
+
+const (
+	// TargetOrigin is "/path?query", what clients send to origin servers
+	TargetOrigin TargetForm = iota
+	// TargetAbsolute is "http://host/path?query", what clients send to proxies
+	TargetAbsolute
+	// TargetAuthority is "host:port", only used by CONNECT
+	TargetAuthority
+	// TargetAsterisk is "*", only used by server-wide OPTIONS
+	TargetAsterisk
+)
+
+// Target is the parsed request-target
+type Target struct {
+	Form TargetForm
+	// Scheme is set for the absolute form
+	Scheme string
+	// Host is host[:port], set for the absolute and authority forms
+	Host string
+	// RawPath is the path with dot segments removed, still escaped, so an encoded "/"
+	// can be told apart from a separator. Path is RawPath percent-decoded; targets whose
+	// decoded path has "." or ".." segments, like "/..%2Fetc", are rejected.
+	// both are empty for the authority and asterisk forms
+	Path    string
+	RawPath string
+	// RawQuery is the query without the "?", as sent
+	RawQuery string
+}
+
+// Query decodes RawQuery. malformed pairs are skipped
+func (t Target) Query() url.Values {
+	values, _ := url.ParseQuery(t.RawQuery)
+	return values
+}
+
+// ParseTarget parses the request-target of a request with method. the form has to fit
+// the method: authority form for CONNECT only, asterisk for OPTIONS only.
+// fragments are rejected, clients never send them
+func ParseTarget(method, raw string) (*Target, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidTarget)
+	}
+	if strings.Contains(raw, "#") {
+		return nil, fmt.Errorf("%w: fragment in %q", ErrInvalidTarget, raw)
+	}
+	for i := 0; i < len(raw); i++ {
+		if raw[i] <= ' ' || raw[i] == 0x7f {
+			return nil, fmt.Errorf("%w: control character in %q", ErrInvalidTarget, raw)
+		}
+	}
+
+	if method == "CONNECT" {
+		if err := checkAuthority(raw, true); err != nil {
+			return nil, err
+		}
+		return &Target{Form: TargetAuthority, Host: raw}, nil
+	}
+	if raw == "*" {
+		if method != "OPTIONS" {
+			return nil, fmt.Errorf("%w: * is only allowed for OPTIONS", ErrInvalidTarget)
+		}
+		return &Target{Form: TargetAsterisk}, nil
+	}
+
+	target := &Target{Form: TargetOrigin}
+	rest := raw
+	if !strings.HasPrefix(raw, "/") {
+		scheme, afterScheme, ok := strings.Cut(raw, "://")
+		if !ok || !validScheme(scheme) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTarget, raw)
+		}
+		authorityEnd := strings.IndexAny(afterScheme, "/?")
+		if authorityEnd < 0 {
+			authorityEnd = len(afterScheme)
+		}
+		host := afterScheme[:authorityEnd]
+		if err := checkAuthority(host, false); err != nil {
+			return nil, err
+		}
+		target.Form = TargetAbsolute
+		target.Scheme = strings.ToLower(scheme)
+		target.Host = host
+		rest = afterScheme[authorityEnd:]
+	}
+
+	rawPath, rawQuery, _ := strings.Cut(rest, "?")
+	if rawPath == "" {
+		// "http://host" and "http://host?q" ask for the root
+		rawPath = "/"
+	}
+	rawPath, err := normalizePath(rawPath)
+	if err != nil {
+		return nil, err
+	}
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+	if hasDotSegment(path) {
+		// an encoded "/" turned into dot segments that were not there before decoding
+		return nil, fmt.Errorf("%w: dot segment in decoded path %q", ErrInvalidTarget, raw)
+	}
+	target.Path = path
+	target.RawPath = rawPath
+	target.RawQuery = rawQuery
+	return target, nil
+}
+
+// checkAuthority validates host[:port]. userinfo is not allowed in HTTP URIs
+func checkAuthority(authority string, requirePort bool) error {
+	if authority == "" || strings.Contains(authority, "@") {
+		return fmt.Errorf("%w: bad authority %q", ErrInvalidTarget, authority)
+	}
+	host, port := authority, ""
+	if i := strings.LastIndex(authority, ":"); i >= 0 && !strings.HasSuffix(authority, "]") {
+		host, port = authority[:i], authority[i+1:]
+		for _, c := range port {
+			if c < '0' || c > '9' {
+				return fmt.Errorf("%w: bad port in %q", ErrInvalidTarget, authority)
+			}
+		}
+	}
+	if host == "" || requirePort && port == "" {
+		return fmt.Errorf("%w: authority form needs host:port, got %q", ErrInvalidTarget, authority)
+	}
+	return nil
+}
+
+func validScheme(scheme string) bool {
+	if scheme == "" {
+		return false
+	}
+	for i, c := range scheme {
+		letter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if i == 0 && !letter {
+			return false
+		}
+		if !letter && !(c >= '0' && c <= '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizePath decodes percent-encoded unreserved characters, so "%2E%2E" counts
+// as "..", upper-cases the remaining escapes and removes dot segments (RFC 3986 section 5.2.4)
+func normalizePath(raw string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '%' {
+			b.WriteByte(raw[i])
+			continue
+		}
+		if i+2 >= len(raw) || !isHex(raw[i+1]) || !isHex(raw[i+2]) {
+			return "", fmt.Errorf("%w: bad escape in %q", ErrInvalidTarget, raw)
+		}
+		c := unhex(raw[i+1])<<4 | unhex(raw[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(strings.ToUpper(raw[i : i+3]))
+		}
+		i += 2
+	}
+	return removeDotSegments(b.String()), nil
+}
+
+// removeDotSegments resolves "." and ".." in a path starting with "/".
+// ".." never climbs above the root
+func removeDotSegments(path string) string {
+	segments := strings.Split(path, "/")[1:]
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, segment)
+			continue
+		}
+		if last {
+			// "/a/." and "/a/b/.." name a directory
+			out = append(out, "")
+		}
+	}
+	return "/" + strings.Join(out, "/")
+}
+
+func hasDotSegment(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func isUnreserved(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case isDigit(c):
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,29 @@
+package response
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// timeFormat is the IMF-fixdate layout of RFC 9110 section 5.6.7
+const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+type cachedDate struct {
+	unix  int64
+	value string
+}
+
+// lastDate is the Date header of the current second, formatting it once
+// per second instead of once per response
+var lastDate atomic.Pointer[cachedDate]
+
+// httpDate formats now as an IMF-fixdate, e.g. "Sun, 06 Nov 1994 08:49:37 GMT"
+func httpDate(now time.Time) string {
+	unix := now.Unix()
+	if cached := lastDate.Load(); cached != nil && cached.unix == unix {
+		return cached.value
+	}
+	value := now.UTC().Format(timeFormat)
+	lastDate.Store(&cachedDate{unix: unix, value: value})
+	return value
+}
@@ -1,141 +1,429 @@
 package response
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"tcpgo/internal/headers"
+	"time"
 )
 
-type StatusCode int
+const WRITER_BUFFER_SIZE = 4096
 
-const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+var (
+	ErrAlreadyFlushed        = errors.New("response already sent to the client")
+	ErrBodyNotAllowed        = errors.New("response status does not allow a body")
+	ErrContentLengthExceeded = errors.New("body longer than the declared Content-Length")
 )
 
+// Writer writes a response to the connection through a buffer.
+// data reaches the client when the buffer fills up or on Flush.
+// parts must be written in order: status line, headers, body, then trailers for chunked bodies
 type Writer struct {
-	Buffer      *bytes.Buffer
-	WriterState int // 0 good, 1 bad
+	dst    *countingWriter
+	buffer *bufio.Writer
+	state  writerState
+	// KeepAlive is set by the server when the connection may serve another request.
+	// a handler that writes "Connection: close" turns it off
+	KeepAlive bool
+	// Version goes in the status line, "1.1" unless the server answers an HTTP/1.0
+	// request. HTTP/1.0 clients can't read chunked bodies, they get the body
+	// unframed and the connection closes after it
+	Version string
+	// Head is set by the server for HEAD requests. headers go out as they would
+	// for GET, including the computed Content-Length, and the body is dropped
+	Head bool
+	// ServerName goes out in the Server header unless the handler sets one. empty sends none
+	ServerName    string
+	status        StatusCode
+	chunked       bool
+	contentLength int
+	bodyWritten   int
+	// pendingHeaders are headers without a length, held back together with pendingBody
+	// until the body is known to be complete (Content-Length) or starts streaming (chunked)
+	pendingHeaders *headers.Headers
+	pendingBody    bytes.Buffer
+	// autoChunked is a chunked body the handler writes with WriteBody
+	autoChunked bool
+	// closeDelimited is a chunked body sent to an HTTP/1.0 client: no chunk framing,
+	// the end of the body is the end of the connection
+	closeDelimited bool
+	// onHeaders run in order right before the headers are written
+	onHeaders []func(*headers.Headers)
+}
+
+func NewWriter(w io.Writer) *Writer {
+	dst := &countingWriter{writer: w}
+	return &Writer{
+		dst:           dst,
+		buffer:        bufio.NewWriterSize(dst, WRITER_BUFFER_SIZE),
+		state:         writerStateStatusLine,
+		contentLength: -1,
+		Version:       "1.1",
+	}
+}
+
+// Flush sends everything written so far to the client. a body without a
+// Content-Length switches to chunked encoding, since more of it may follow
+func (w *Writer) Flush() error {
+	if w.pendingHeaders != nil && !w.Head {
+		if err := w.startChunked(); err != nil {
+			return err
+		}
+	}
+	return w.buffer.Flush()
+}
+
+// Status is the status code written so far, 0 before the status line
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// OnHeaders registers fn to adjust the headers right before they are written,
+// whichever code path writes them. middleware uses it to add response headers
+func (w *Writer) OnHeaders(fn func(*headers.Headers)) {
+	w.onHeaders = append(w.onHeaders, fn)
+}
+
+// Flushed reports whether any part of the response has reached the client
+func (w *Writer) Flushed() bool {
+	return w.dst.written > 0
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	err := WriteStatusLine(w.Buffer, statusCode)
+	if w.state != writerStateStatusLine {
+		return &WriterStateError{Op: "write status line", State: w.state}
+	}
+	err := writeStatusLine(w.buffer, w.Version, statusCode)
 	if err != nil {
 		return err
 	}
+	w.status = statusCode
+	w.state = writerStateHeaders
 	return nil
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
-	err := WriteHeaders(w.Buffer, headers)
+// WriteHeaders adds Date, Server and Connection unless they are set. headers with
+// neither Content-Length nor Transfer-Encoding are held back: the length is filled
+// in by Finish, or the body goes out chunked once it outgrows the buffer or is flushed
+func (w *Writer) WriteHeaders(headers *headers.Headers) error {
+	if w.state != writerStateHeaders {
+		return &WriterStateError{Op: "write headers", State: w.state}
+	}
+	for _, fn := range w.onHeaders {
+		fn(headers)
+	}
+	if transferEncoding, exists := headers.Get("Transfer-Encoding"); exists && w.Version == "1.0" && strings.EqualFold(transferEncoding, "chunked") {
+		headers.Del("Transfer-Encoding")
+		headers.Del("Trailer")
+		NewConnection("close")(headers)
+		w.chunked = true
+		w.closeDelimited = true
+	}
+	if connection, exists := headers.Get("Connection"); exists {
+		if strings.EqualFold(connection, "close") {
+			w.KeepAlive = false
+		}
+	} else if w.KeepAlive {
+		NewConnection("keep-alive")(headers)
+	} else {
+		NewConnection("close")(headers)
+	}
+	if !headers.Has("Date") {
+		NewDate()(headers)
+	}
+	if w.ServerName != "" && !headers.Has("Server") {
+		NewServer(w.ServerName)(headers)
+	}
+
+	transferEncoding, hasTransferEncoding := headers.Get("Transfer-Encoding")
+	_, hasContentLength := headers.Get("Content-Length")
+	if !w.closeDelimited && !hasTransferEncoding && !hasContentLength && bodyAllowed(w.status) {
+		w.pendingHeaders = headers
+		w.state = writerStateBody
+		return nil
+	}
+	if hasTransferEncoding {
+		w.chunked = strings.EqualFold(transferEncoding, "chunked")
+	}
+	if contentLength, exists := headers.Get("Content-Length"); exists {
+		if l, err := strconv.Atoi(contentLength); err == nil {
+			w.contentLength = l
+		}
+	}
+
+	err := WriteHeaders(w.buffer, headers)
 	if err != nil {
 		return err
 	}
+	w.state = writerStateBody
 	return nil
 }
 
+// WriteBody writes part of an unframed or Content-Length body. writing past the
+// declared length, or any body for a status like 204 or 304, is an error
 func (w *Writer) WriteBody(body []byte) error {
-	_, err := w.Buffer.Write(body)
+	if w.state != writerStateBody {
+		return &WriterStateError{Op: "write body", State: w.state}
+	}
+	if w.chunked && !w.autoChunked {
+		return &WriterStateError{Op: "write unframed body", State: w.state}
+	}
+	if len(body) > 0 && !bodyAllowed(w.status) {
+		return ErrBodyNotAllowed
+	}
+	if w.contentLength >= 0 && w.bodyWritten+len(body) > w.contentLength {
+		// nothing is written, the client would read the excess as the next response
+		return ErrContentLengthExceeded
+	}
+	if w.pendingHeaders != nil && w.Head {
+		// only the length matters, see writePending
+		w.bodyWritten += len(body)
+		return nil
+	}
+	if w.pendingHeaders != nil {
+		w.pendingBody.Write(body)
+		if w.pendingBody.Len() <= WRITER_BUFFER_SIZE {
+			return nil
+		}
+		return w.startChunked()
+	}
+	if w.autoChunked {
+		return w.writeChunk(body)
+	}
+	return w.writeBody(body)
+}
+
+// startChunked sends the held back headers with Transfer-Encoding: chunked
+// and what was written of the body so far as the first chunk.
+// for HTTP/1.0 it closes the connection after the body instead
+func (w *Writer) startChunked() error {
+	headers := w.pendingHeaders
+	w.pendingHeaders = nil
+	if w.Version == "1.0" {
+		NewConnection("close")(headers)
+		w.KeepAlive = false
+		w.closeDelimited = true
+	} else {
+		NewTransferEncoding("chunked")(headers)
+	}
+	w.chunked = true
+	w.autoChunked = true
+	if err := WriteHeaders(w.buffer, headers); err != nil {
+		return err
+	}
+	body := w.pendingBody.Bytes()
+	w.pendingBody.Reset()
+	return w.writeChunk(body)
+}
+
+// writePending sends the held back headers with the Content-Length of the complete body
+func (w *Writer) writePending() error {
+	headers := w.pendingHeaders
+	w.pendingHeaders = nil
+	length := w.pendingBody.Len()
+	if w.Head {
+		length = w.bodyWritten
+	}
+	NewContentLength(length)(headers)
+	w.contentLength = length
+	if err := WriteHeaders(w.buffer, headers); err != nil {
+		return err
+	}
+	err := w.writeBody(w.pendingBody.Bytes())
+	w.pendingBody.Reset()
+	return err
+}
+
+func (w *Writer) writeBody(body []byte) error {
+	if w.Head {
+		w.bodyWritten += len(body)
+		return nil
+	}
+	n, err := w.buffer.Write(body)
+	w.bodyWritten += n
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// ResetBuffer drops everything written so far, so the handler can start over
+// with a different response. it fails once part of the response was flushed
 func (w *Writer) ResetBuffer() error {
-	return w.ResetBuffer()
+	if w.Flushed() {
+		return ErrAlreadyFlushed
+	}
+	w.buffer.Reset(w.dst)
+	w.state = writerStateStatusLine
+	w.status = 0
+	w.chunked = false
+	w.autoChunked = false
+	w.closeDelimited = false
+	w.contentLength = -1
+	w.bodyWritten = 0
+	w.pendingHeaders = nil
+	w.pendingBody.Reset()
+	return nil
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.state != writerStateBody || !w.chunked {
+		return 0, &WriterStateError{Op: "write chunk", State: w.state}
+	}
+	if len(p) > 0 && !bodyAllowed(w.status) {
+		return 0, ErrBodyNotAllowed
+	}
+	if len(p) == 0 {
+		// a zero sized chunk would end the body
+		return 0, nil
+	}
+	err := w.writeChunk(p)
+	return len(p) + len(fmt.Sprintf("%x", len(p))) + 4, err
+}
+
+func (w *Writer) writeChunk(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if w.closeDelimited {
+		return w.writeBody(p)
+	}
 	lenInStr := fmt.Sprintf("%x\r\n", len(p))
 	var buffer bytes.Buffer
 	buffer.Write([]byte(lenInStr))
 	buffer.Write(p)
 	buffer.Write([]byte("\r\n"))
 
-	err := w.WriteBody(buffer.Bytes())
-
-	return buffer.Len(), err
+	return w.writeBody(buffer.Bytes())
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.state != writerStateBody || !w.chunked {
+		return 0, &WriterStateError{Op: "end chunked body", State: w.state}
+	}
+	if w.closeDelimited {
+		w.state = writerStateTrailers
+		return 0, nil
+	}
 	body := []byte("0\r\n")
-	err := w.WriteBody(body)
-	return len(body), err
+	err := w.writeBody(body)
+	if err != nil {
+		return 0, err
+	}
+	w.state = writerStateTrailers
+	return len(body), nil
 }
 
-func (w *Writer) WriteBodyTrailers(p []byte) (int, error) {
-	var buffer bytes.Buffer
-	buffer.Write(p)
-	buffer.Write([]byte("\r\n"))
-	w.WriteBody(buffer.Bytes())
+// WriteTrailers writes the trailer fields after the last chunk and ends the response
+func (w *Writer) WriteTrailers(trailers *headers.Headers) error {
+	if w.state != writerStateTrailers {
+		return &WriterStateError{Op: "write trailers", State: w.state}
+	}
+	if w.Head || w.closeDelimited {
+		w.state = writerStateDone
+		return nil
+	}
+	for key, value := range trailers.All() {
+		if _, err := fmt.Fprintf(w.buffer, "%s: %s\r\n", key, value); err != nil {
+			return err
+		}
+	}
+	if _, err := w.buffer.Write([]byte("\r\n")); err != nil {
+		return err
+	}
+	w.state = writerStateDone
+	return nil
+}
 
-	return buffer.Len(), nil
+// Abort gives up on the response. nothing more can be written and the server
+// closes the connection, so the client sees a truncated response rather than a wrong one
+func (w *Writer) Abort() {
+	w.state = writerStateAborted
+	w.KeepAlive = false
 }
 
-func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	var HTTPVersion = "1.1"
-	var Protocol = "HTTP"
-	switch statusCode {
-	case StatusOK:
-		statusLine := fmt.Sprint(Protocol, "/", HTTPVersion, " ", StatusOK, " ", "OK", "\r\n")
-		_, err := w.Write([]byte(statusLine))
-		if err != nil {
+// Finish completes whatever the handler left out: a 200 status line, default headers,
+// the terminating chunk and the end of the trailers. the server calls it after the handler returns
+func (w *Writer) Finish() error {
+	if w.state == writerStateStatusLine {
+		if err := w.WriteStatusLine(StatusOK); err != nil {
 			return err
 		}
-		return nil
-	case StatusBadRequest:
-		statusLine := fmt.Sprint(Protocol, "/", HTTPVersion, " ", StatusBadRequest, " ", "Bad Request", "\r\n")
-		_, err := w.Write([]byte(statusLine))
-		if err != nil {
+	}
+	if w.state == writerStateHeaders {
+		if err := w.WriteHeaders(NewResponseHeaders()); err != nil {
 			return err
 		}
-		return nil
-	case StatusInternalServerError:
-		statusLine := fmt.Sprint(Protocol, "/", HTTPVersion, " ", StatusInternalServerError, " ", "Internal Server Error", "\r\n")
-		_, err := w.Write([]byte(statusLine))
-		if err != nil {
+	}
+	if w.pendingHeaders != nil {
+		if err := w.writePending(); err != nil {
 			return err
 		}
-		return nil
-	default:
-		statusLine := fmt.Sprint(Protocol, "/", HTTPVersion, " ", statusCode, " ", "\r\n")
-		_, err := w.Write([]byte(statusLine))
-		if err != nil {
+	}
+	if w.state == writerStateBody {
+		if w.chunked {
+			if _, err := w.WriteChunkedBodyDone(); err != nil {
+				return err
+			}
+		} else {
+			if !w.Head && w.contentLength >= 0 && w.bodyWritten != w.contentLength {
+				// the client can't tell where this response ends
+				w.KeepAlive = false
+			}
+			w.state = writerStateDone
+		}
+	}
+	if w.state == writerStateTrailers {
+		if err := w.WriteTrailers(headers.NewHeaders()); err != nil {
 			return err
 		}
-		return nil
 	}
+	return nil
+}
+
+// WriteStatusLine writes an HTTP/1.1 status line with the reason phrase from StatusText.
+// codes without a known reason get an empty one, codes outside 100-999 are rejected
+func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
+	return writeStatusLine(w, "1.1", statusCode)
+}
+
+func writeStatusLine(w io.Writer, version string, statusCode StatusCode) error {
+	if statusCode < 100 || statusCode > 999 {
+		return fmt.Errorf("%w: %d", ErrInvalidStatusCode, statusCode)
+	}
+	_, err := fmt.Fprintf(w, "HTTP/%s %d %s\r\n", version, statusCode, StatusText(statusCode))
+	return err
 }
 
 // function optional
-// I don't use pointer here, since maps are already ref types
-func NewResponseHeaders(headerCfgs ...ResponseHeaderCfg) headers.Headers {
-	headers := headers.Headers{}
+func NewResponseHeaders(headerCfgs ...ResponseHeaderCfg) *headers.Headers {
+	headers := headers.NewHeaders()
 	for _, cfg := range headerCfgs {
 		cfg(headers)
 	}
 	return headers
 }
 
-type ResponseHeaderCfg func(headers.Headers)
+type ResponseHeaderCfg func(*headers.Headers)
 
 func NewContentType(cType string) ResponseHeaderCfg {
-	return func(h headers.Headers) {
-		h["Content-type"] = cType
+	return func(h *headers.Headers) {
+		h.Set("Content-Type", cType)
 	}
 }
 func NewContentLength(l int) ResponseHeaderCfg {
-	return func(h headers.Headers) {
-		h["Content-Length"] = fmt.Sprint(l)
+	return func(h *headers.Headers) {
+		h.Set("Content-Length", fmt.Sprint(l))
 	}
 }
 func NewTransferEncoding(ct string) ResponseHeaderCfg {
-	return func(h headers.Headers) {
-		h["Transfer-Encoding"] = ct
+	return func(h *headers.Headers) {
+		h.Set("Transfer-Encoding", ct)
 	}
 }
 func NewConnection(ct string) ResponseHeaderCfg {
@@ -143,22 +431,56 @@ func NewConnection(ct string) ResponseHeaderCfg {
 		ct = "close"
 	}
 
-	return func(h headers.Headers) {
-		h["Connection"] = ct
+	return func(h *headers.Headers) {
+		h.Set("Connection", ct)
+	}
+}
+func NewDate() ResponseHeaderCfg {
+	return func(h *headers.Headers) {
+		h.Set("Date", httpDate(time.Now()))
+	}
+}
+func NewServer(name string) ResponseHeaderCfg {
+	return func(h *headers.Headers) {
+		h.Set("Server", name)
+	}
+}
+func NewAllow(methods []string) ResponseHeaderCfg {
+	return func(h *headers.Headers) {
+		h.Set("Allow", strings.Join(methods, ", "))
 	}
 }
 func NewTrailer(trailers []string) ResponseHeaderCfg {
-	return func(h headers.Headers) {
-		h["Trailer"] = strings.Join(trailers, ", ")
+	return func(h *headers.Headers) {
+		h.Set("Trailer", strings.Join(trailers, ", "))
 	}
 }
 
-func WriteHeaders(w io.Writer, headers headers.Headers) error {
-	headerList := make([]string, 0, len(headers))
-	for key, value := range headers {
-		headerList = append(headerList, fmt.Sprintf("%s: %s", key, value))
+// WriteHeaders writes the fields in the order they were added, then the empty line
+func WriteHeaders(w io.Writer, headers *headers.Headers) error {
+	var buffer bytes.Buffer
+	for key, value := range headers.All() {
+		fmt.Fprintf(&buffer, "%s: %s\r\n", key, value)
 	}
+	buffer.WriteString("\r\n")
 
-	_, err := w.Write([]byte(strings.Join(headerList, "\r\n") + "\r\n\r\n"))
+	_, err := w.Write(buffer.Bytes())
 	return err
 }
+
+// bodyAllowed reports whether a response with this status can carry a body
+func bodyAllowed(status StatusCode) bool {
+	return status >= 200 && status != StatusNoContent && status != StatusNotModified
+}
+
+// countingWriter remembers how many bytes went through to the connection
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,300 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"tcpgo/internal/headers"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterState(t *testing.T) {
+	// TEST: Body before status line
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	err := w.WriteBody([]byte("hello"))
+	var stateErr *WriterStateError
+	require.ErrorAs(t, err, &stateErr)
+
+	// TEST: Headers written twice
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders(NewContentLength(0))))
+	err = w.WriteHeaders(NewResponseHeaders(NewContentLength(0)))
+	require.ErrorAs(t, err, &stateErr)
+
+	// TEST: Finish fills in status line and headers
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.Regexp(t, "^HTTP/1.1 200 OK\r\nConnection: close\r\nDate: [^\r]+ GMT\r\nContent-Length: 0\r\n\r\n$", buf.String())
+
+	// TEST: Finish terminates a chunked body
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders(NewTransferEncoding("chunked"))))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	err = w.WriteBody([]byte("unframed"))
+	require.ErrorAs(t, err, &stateErr)
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+
+	// TEST: An aborted chunked body is left unterminated, even once Finish runs
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.KeepAlive = true
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders(NewTransferEncoding("chunked"))))
+	_, err = w.WriteChunkedBody([]byte("partial"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	require.ErrorIs(t, w.ResetBuffer(), ErrAlreadyFlushed)
+	w.Abort()
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "7\r\npartial\r\n")
+	assert.NotContains(t, buf.String(), "0\r\n\r\n")
+	assert.False(t, w.KeepAlive)
+
+	// TEST: Trailers after the last chunk
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders(NewTransferEncoding("chunked"))))
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	err = w.WriteTrailers(trailers)
+	require.ErrorAs(t, err, &stateErr)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "0\r\nX-Checksum: abc\r\n\r\n")
+
+	// TEST: Short body turns off keep-alive
+	w = NewWriter(&buf)
+	w.KeepAlive = true
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders(NewContentLength(10))))
+	require.NoError(t, w.WriteBody([]byte("short")))
+	require.NoError(t, w.Finish())
+	assert.False(t, w.KeepAlive)
+}
+
+func TestWriterBodyFraming(t *testing.T) {
+	// TEST: Writing past Content-Length fails and writes nothing
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders(NewContentLength(3))))
+	assert.ErrorIs(t, w.WriteBody([]byte("hello world")), ErrContentLengthExceeded)
+	require.NoError(t, w.WriteBody([]byte("he")))
+	assert.ErrorIs(t, w.WriteBody([]byte("ll")), ErrContentLengthExceeded)
+	require.NoError(t, w.WriteBody([]byte("l")))
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhel"))
+
+	// TEST: No body for statuses that don't allow one
+	for _, status := range []StatusCode{StatusNoContent, StatusNotModified} {
+		buf.Reset()
+		w = NewWriter(&buf)
+		require.NoError(t, w.WriteStatusLine(status))
+		require.NoError(t, w.WriteHeaders(NewResponseHeaders()))
+		assert.ErrorIs(t, w.WriteBody([]byte("body")), ErrBodyNotAllowed)
+		require.NoError(t, w.WriteBody(nil))
+		require.NoError(t, w.Finish())
+		require.NoError(t, w.Flush())
+		assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+		assert.NotContains(t, buf.String(), "body")
+	}
+
+	// TEST: Nor as chunks
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders(NewTransferEncoding("chunked"))))
+	_, err := w.WriteChunkedBody([]byte("body"))
+	assert.ErrorIs(t, err, ErrBodyNotAllowed)
+}
+
+func TestWriteStatusLine(t *testing.T) {
+	// TEST: Known codes get their reason phrase
+	var buf bytes.Buffer
+	require.NoError(t, WriteStatusLine(&buf, StatusNotFound))
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n", buf.String())
+	assert.Equal(t, "Service Unavailable", StatusText(StatusServiceUnavailable))
+	assert.Equal(t, "Request Header Fields Too Large", StatusText(StatusHeaderFieldsTooLarge))
+
+	// TEST: Unknown three digit code has an empty reason
+	buf.Reset()
+	require.NoError(t, WriteStatusLine(&buf, 599))
+	assert.Equal(t, "HTTP/1.1 599 \r\n", buf.String())
+
+	// TEST: Codes outside 100-999 are rejected
+	buf.Reset()
+	assert.ErrorIs(t, WriteStatusLine(&buf, 99), ErrInvalidStatusCode)
+	assert.ErrorIs(t, WriteStatusLine(&buf, 1000), ErrInvalidStatusCode)
+	assert.Zero(t, buf.Len())
+
+	// TEST: Writer stays at the status line after an invalid code
+	w := NewWriter(&buf)
+	assert.ErrorIs(t, w.WriteStatusLine(42), ErrInvalidStatusCode)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+}
+
+func TestWriterFraming(t *testing.T) {
+	// TEST: Content-Length is computed for a body written in one go
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.ServerName = "tcpgo"
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders(NewContentType("text/plain"))))
+	require.NoError(t, w.WriteBody([]byte("hello ")))
+	require.NoError(t, w.WriteBody([]byte("world")))
+	assert.False(t, w.Flushed())
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.Regexp(t, "^HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nConnection: close\r\nDate: [^\r]+\r\nServer: tcpgo\r\nContent-Length: 11\r\n\r\nhello world$", buf.String())
+
+	// TEST: Handler set Date and Server win
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.ServerName = "tcpgo"
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := NewResponseHeaders(NewContentLength(0), NewServer("custom"))
+	h.Set("Date", "Sun, 06 Nov 1994 08:49:37 GMT")
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "Server: custom\r\n")
+	assert.Contains(t, buf.String(), "Date: Sun, 06 Nov 1994 08:49:37 GMT\r\n")
+	assert.Equal(t, 1, strings.Count(buf.String(), "Date:"))
+
+	// TEST: Flush without a length switches to chunked
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders()))
+	require.NoError(t, w.WriteBody([]byte("first")))
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\n")
+	assert.NotContains(t, buf.String(), "Content-Length")
+	require.NoError(t, w.WriteBody([]byte("second")))
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nfirst\r\n6\r\nsecond\r\n0\r\n\r\n"))
+
+	// TEST: A body larger than the buffer switches to chunked
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders()))
+	require.NoError(t, w.WriteBody(bytes.Repeat([]byte("a"), WRITER_BUFFER_SIZE+1)))
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\n")
+	assert.Contains(t, buf.String(), fmt.Sprintf("\r\n\r\n%x\r\n", WRITER_BUFFER_SIZE+1))
+
+	// TEST: No Content-Length for a status without a body
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.NotContains(t, buf.String(), "Content-Length")
+	assert.NotContains(t, buf.String(), "Transfer-Encoding")
+
+	// TEST: Head drops a chunked body along with its trailers
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.Head = true
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders(NewTransferEncoding("chunked"), NewTrailer([]string{"X-Checksum"}))))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.Contains(t, buf.String(), "Transfer-Encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "GMT\r\n\r\n"))
+
+	// TEST: Date is formatted as an IMF-fixdate and cached within a second
+	now := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", httpDate(now))
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", httpDate(now.Add(500*time.Millisecond)))
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:38 GMT", httpDate(now.Add(time.Second)))
+}
+
+func TestWriterHTTP10(t *testing.T) {
+	// TEST: Status line carries the version
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Version = "1.0"
+	w.KeepAlive = true
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders()))
+	require.NoError(t, w.WriteBody([]byte("hello")))
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.0 200 OK\r\n"))
+	assert.Contains(t, buf.String(), "Content-Length: 5\r\n")
+	assert.Contains(t, buf.String(), "Connection: keep-alive\r\n")
+	assert.True(t, w.KeepAlive)
+
+	// TEST: A chunked body goes out unframed and closes the connection
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.Version = "1.0"
+	w.KeepAlive = true
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders(NewTransferEncoding("chunked"), NewTrailer([]string{"X-Checksum"}))))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.NotContains(t, buf.String(), "Transfer-Encoding")
+	assert.NotContains(t, buf.String(), "Trailer")
+	assert.NotContains(t, buf.String(), "X-Checksum")
+	assert.Contains(t, buf.String(), "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello world"))
+	assert.False(t, w.KeepAlive)
+
+	// TEST: A flushed body without a length closes the connection instead of chunking
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.Version = "1.0"
+	w.KeepAlive = true
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(NewResponseHeaders()))
+	require.NoError(t, w.WriteBody([]byte("first")))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.WriteBody([]byte("second")))
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Flush())
+	assert.NotContains(t, buf.String(), "Transfer-Encoding")
+	assert.Contains(t, buf.String(), "Connection: close\r\n")
+	assert.NotContains(t, buf.String(), "keep-alive")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nfirstsecond"))
+	assert.False(t, w.KeepAlive)
+}
@@ -0,0 +1,43 @@
+package response
+
+import "fmt"
+
+type writerState int
+
+const (
+	writerStateStatusLine writerState = iota
+	writerStateHeaders
+	writerStateBody
+	writerStateTrailers
+	writerStateDone
+	writerStateAborted
+)
+
+func (s writerState) String() string {
+	switch s {
+	case writerStateStatusLine:
+		return "waiting for status line"
+	case writerStateHeaders:
+		return "waiting for headers"
+	case writerStateBody:
+		return "writing body"
+	case writerStateTrailers:
+		return "waiting for trailers"
+	case writerStateDone:
+		return "done"
+	case writerStateAborted:
+		return "aborted"
+	default:
+		return "unknown"
+	}
+}
+
+// WriterStateError is returned when a Writer method is called out of order
+type WriterStateError struct {
+	Op    string
+	State writerState
+}
+
+func (e *WriterStateError) Error() string {
+	return fmt.Sprintf("cannot %s: writer is %s", e.Op, e.State)
+}
@@ -0,0 +1,259 @@
+package router
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"tcpgo/internal/request"
+	"tcpgo/internal/response"
+	"tcpgo/internal/server"
+)
+
+type segmentKind int
+
+// kinds are ordered from the most to the least specific
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentWildcard
+)
+
+type segment struct {
+	kind segmentKind
+	// value is the literal text, or the parameter name
+	value string
+}
+
+type route struct {
+	// method is empty for routes that match any method
+	method   string
+	pattern  string
+	segments []segment
+	handler  server.Handler
+}
+
+// Router dispatches requests to handlers registered by method and path pattern
+type Router struct {
+	routes []*route
+	// NotFound answers requests no pattern matches. defaults to a plain 404
+	NotFound server.Handler
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// Handle registers handler for method and pattern. an empty method matches any method.
+// a pattern is "/"-separated segments, each one literal text or {name} matching a single
+// segment. the last segment may also be {name...} or * matching the rest of the path.
+// like net/http, it panics on a malformed pattern or one registered twice
+func (r *Router) Handle(method, pattern string, handler server.Handler) {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	for _, existing := range r.routes {
+		if existing.method == method && samePattern(existing.segments, segments) {
+			panic(fmt.Sprintf("router: %s %s conflicts with %s %s", method, pattern, existing.method, existing.pattern))
+		}
+	}
+	r.routes = append(r.routes, &route{
+		method:   method,
+		pattern:  pattern,
+		segments: segments,
+		handler:  handler,
+	})
+}
+
+// ServeRequest is a server.Handler. the most specific pattern wins, path parameters
+// end up in req.PathParams. HEAD requests fall back to GET routes. a path matched
+// only for other methods gets a 405 with Allow
+func (r *Router) ServeRequest(w *response.Writer, req *request.Request) {
+	pathSegments := splitPath(req.RequestLine)
+
+	var best *route
+	var bestParams map[string]string
+	allowed := []string{}
+	for _, rt := range r.routes {
+		params, ok := rt.match(pathSegments)
+		if !ok {
+			continue
+		}
+		if methodRank(rt.method, req.RequestLine.Method) < 0 {
+			allowed = append(allowed, rt.method)
+			if rt.method == "GET" {
+				allowed = append(allowed, "HEAD")
+			}
+			continue
+		}
+		if best == nil || rt.moreSpecific(best, req.RequestLine.Method) {
+			best = rt
+			bestParams = params
+		}
+	}
+
+	if best != nil {
+		req.PathParams = bestParams
+		best.handler(w, req)
+		return
+	}
+	if len(allowed) > 0 {
+		slices.Sort(allowed)
+		methodNotAllowed(w, slices.Compact(allowed))
+		return
+	}
+	if r.NotFound != nil {
+		r.NotFound(w, req)
+		return
+	}
+	notFound(w, req)
+}
+
+func (rt *route) match(pathSegments []string) (map[string]string, bool) {
+	params := map[string]string{}
+	for i, seg := range rt.segments {
+		if i >= len(pathSegments) {
+			return nil, false
+		}
+		switch seg.kind {
+		case segmentWildcard:
+			if seg.value != "" {
+				params[seg.value] = strings.Join(pathSegments[i:], "/")
+			}
+			return params, true
+		case segmentParam:
+			if pathSegments[i] == "" {
+				return nil, false
+			}
+			params[seg.value] = pathSegments[i]
+		case segmentLiteral:
+			if pathSegments[i] != seg.value {
+				return nil, false
+			}
+		}
+	}
+	return params, len(pathSegments) == len(rt.segments)
+}
+
+// methodRank orders how well a route method fits the request method, -1 is no match.
+// GET routes also serve HEAD, the server drops the body
+func methodRank(routeMethod, method string) int {
+	switch {
+	case routeMethod == method:
+		return 2
+	case routeMethod == "GET" && method == "HEAD":
+		return 1
+	case routeMethod == "":
+		return 0
+	default:
+		return -1
+	}
+}
+
+// moreSpecific compares segment by segment: literal text beats {name}, which beats wildcards.
+// on the same pattern the better methodRank wins
+func (rt *route) moreSpecific(other *route, method string) bool {
+	for i := 0; i < len(rt.segments) && i < len(other.segments); i++ {
+		if rt.segments[i].kind != other.segments[i].kind {
+			return rt.segments[i].kind < other.segments[i].kind
+		}
+	}
+	if len(rt.segments) != len(other.segments) {
+		return len(rt.segments) > len(other.segments)
+	}
+	return methodRank(rt.method, method) > methodRank(other.method, method)
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("router: pattern %q must start with /", pattern)
+	}
+	parts := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	segments := make([]segment, 0, len(parts))
+	names := map[string]bool{}
+	for i, part := range parts {
+		seg := segment{kind: segmentLiteral, value: part}
+		if part == "*" {
+			seg = segment{kind: segmentWildcard}
+		} else if name, ok := strings.CutPrefix(part, "{"); ok {
+			name, ok = strings.CutSuffix(name, "}")
+			if !ok {
+				return nil, fmt.Errorf("router: pattern %q: unclosed {", pattern)
+			}
+			seg.kind = segmentParam
+			if rest, ok := strings.CutSuffix(name, "..."); ok {
+				seg.kind = segmentWildcard
+				name = rest
+			}
+			if name == "" {
+				return nil, fmt.Errorf("router: pattern %q: empty parameter name", pattern)
+			}
+			if names[name] {
+				return nil, fmt.Errorf("router: pattern %q: duplicate parameter %q", pattern, name)
+			}
+			names[name] = true
+			seg.value = name
+		}
+		if seg.kind == segmentWildcard && i != len(parts)-1 {
+			return nil, fmt.Errorf("router: pattern %q: wildcard must be the last segment", pattern)
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// samePattern reports whether two patterns match exactly the same paths
+func samePattern(a, b []segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].kind != b[i].kind {
+			return false
+		}
+		if a[i].kind == segmentLiteral && a[i].value != b[i].value {
+			return false
+		}
+	}
+	return true
+}
+
+// splitPath splits the escaped path and decodes each segment on its own,
+// so an encoded "/" stays inside its segment. authority and asterisk form
+// targets have no path and match no route
+func splitPath(requestLine request.RequestLine) []string {
+	target := requestLine.Target
+	if target.Form == request.TargetOrigin && target.RawPath == "" {
+		// a request built by hand rather than read off a connection
+		parsed, err := request.ParseTarget(requestLine.Method, requestLine.RequestTarget)
+		if err != nil {
+			return nil
+		}
+		target = *parsed
+	}
+	if target.RawPath == "" {
+		return nil
+	}
+	segments := strings.Split(strings.TrimPrefix(target.RawPath, "/"), "/")
+	for i, segment := range segments {
+		if decoded, err := url.PathUnescape(segment); err == nil {
+			segments[i] = decoded
+		}
+	}
+	return segments
+}
+
+func notFound(w *response.Writer, req *request.Request) {
+	body := "404 Not Found"
+	w.WriteStatusLine(response.StatusNotFound)
+	w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(body)), response.NewContentType("text/plain")))
+	w.WriteBody([]byte(body))
+}
+
+func methodNotAllowed(w *response.Writer, allowed []string) {
+	body := "405 Method Not Allowed"
+	w.WriteStatusLine(response.StatusMethodNotAllowed)
+	w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(body)), response.NewContentType("text/plain"), response.NewAllow(allowed)))
+	w.WriteBody([]byte(body))
+}
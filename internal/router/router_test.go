@@ -0,0 +1,104 @@
+package router
+
+import (
+	"bytes"
+	"tcpgo/internal/request"
+	"tcpgo/internal/response"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serve runs one request through the router and returns the raw response
+func serve(r *Router, method, target string) string {
+	var out bytes.Buffer
+	w := response.NewWriter(&out)
+	req := &request.Request{RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"}}
+	r.ServeRequest(w, req)
+	w.Finish()
+	w.Flush()
+	return out.String()
+}
+
+func named(name string) func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		body := name
+		for _, key := range []string{"id", "path"} {
+			if v := req.PathValue(key); v != "" {
+				body += " " + key + "=" + v
+			}
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(body))))
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestRouter(t *testing.T) {
+	r := New()
+	r.Handle("GET", "/", named("root"))
+	r.Handle("GET", "/users/{id}", named("user"))
+	r.Handle("DELETE", "/users/{id}", named("delete"))
+	r.Handle("GET", "/users/me", named("me"))
+	r.Handle("GET", "/files/{path...}", named("files"))
+	r.Handle("", "/any", named("any"))
+	r.Handle("POST", "/any", named("post"))
+
+	// TEST: Literal root
+	assert.Contains(t, serve(r, "GET", "/"), "\r\n\r\nroot")
+
+	// TEST: Named parameter, query is ignored
+	assert.Contains(t, serve(r, "GET", "/users/42?full=1"), "\r\n\r\nuser id=42")
+
+	// TEST: Literal segment beats a parameter
+	assert.Contains(t, serve(r, "GET", "/users/me"), "\r\n\r\nme")
+
+	// TEST: Same path, other method
+	assert.Contains(t, serve(r, "DELETE", "/users/42"), "\r\n\r\ndelete id=42")
+
+	// TEST: Wildcard matches the rest of the path
+	assert.Contains(t, serve(r, "GET", "/files/a/b/c.txt"), "\r\n\r\nfiles path=a/b/c.txt")
+	assert.Contains(t, serve(r, "GET", "/files/"), "\r\n\r\nfiles")
+	assert.Contains(t, serve(r, "GET", "/files"), "404 Not Found")
+
+	// TEST: Routing uses the decoded, normalized path
+	assert.Contains(t, serve(r, "GET", "/files/../users/%6De"), "\r\n\r\nme")
+	assert.Contains(t, serve(r, "GET", "/users/a%2Fb"), "\r\n\r\nuser id=a/b")
+	assert.Contains(t, serve(r, "GET", "http://example.com/users/7?x=1"), "\r\n\r\nuser id=7")
+
+	// TEST: Targets without a path match no route
+	assert.Contains(t, serve(r, "OPTIONS", "*"), "404 Not Found")
+
+	// TEST: Empty segment doesn't fill a parameter
+	assert.Contains(t, serve(r, "GET", "/users/"), "404 Not Found")
+
+	// TEST: Unknown path is a 404
+	res := serve(r, "GET", "/nope")
+	assert.Contains(t, res, "HTTP/1.1 404 Not Found\r\n")
+
+	// TEST: Known path, wrong method is a 405 listing the allowed methods
+	res = serve(r, "PUT", "/users/42")
+	assert.Contains(t, res, "HTTP/1.1 405 Method Not Allowed\r\n")
+	assert.Contains(t, res, "Allow: DELETE, GET, HEAD\r\n")
+
+	// TEST: HEAD falls back to the GET route, unless it has its own
+	assert.Contains(t, serve(r, "HEAD", "/users/42"), "\r\n\r\nuser id=42")
+	r.Handle("HEAD", "/users/{id}", named("head"))
+	assert.Contains(t, serve(r, "HEAD", "/users/42"), "\r\n\r\nhead id=42")
+
+	// TEST: A method-specific route beats one for any method
+	assert.Contains(t, serve(r, "POST", "/any"), "\r\n\r\npost")
+	assert.Contains(t, serve(r, "PATCH", "/any"), "\r\n\r\nany")
+
+	// TEST: Custom NotFound handler
+	r.NotFound = named("custom")
+	assert.Contains(t, serve(r, "GET", "/nope"), "\r\n\r\ncustom")
+
+	// TEST: Malformed and conflicting patterns panic
+	assert.Panics(t, func() { r.Handle("GET", "users", named("x")) })
+	assert.Panics(t, func() { r.Handle("GET", "/a/{id", named("x")) })
+	assert.Panics(t, func() { r.Handle("GET", "/a/{}", named("x")) })
+	assert.Panics(t, func() { r.Handle("GET", "/a/{id}/{id}", named("x")) })
+	assert.Panics(t, func() { r.Handle("GET", "/a/{rest...}/b", named("x")) })
+	assert.Panics(t, func() { r.Handle("GET", "/users/{name}", named("x")) })
+}
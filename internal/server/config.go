@@ -0,0 +1,266 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net"
+	"tcpgo/internal/request"
+	"time"
+)
+
+const (
+	defaultReadHeaderTimeout  = 10 * time.Second
+	defaultIdleTimeout        = 5 * time.Second
+	defaultMaxRequestsPerConn = 100
+	defaultCertReloadInterval = 10 * time.Second
+	defaultServerName         = "tcpgo"
+)
+
+// Config holds every knob of a Server. build one with NewConfig, or start from
+// DefaultConfig and set fields directly
+type Config struct {
+	// Addr is the address to listen on, e.g. ":42069" or "unix:///run/tcpgo.sock".
+	// it is ignored when Listener is set
+	Addr     string
+	Listener net.Listener
+
+	// ReadHeaderTimeout bounds the request line and headers once the first byte arrived.
+	// zero falls back to ReadTimeout
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds reading a whole request, body included. when zero, each read
+	// of the body only has ReadHeaderTimeout to get data
+	ReadTimeout time.Duration
+	// WriteTimeout bounds writing a response. zero disables it
+	WriteTimeout time.Duration
+	// IdleTimeout bounds the wait for the next request on a keep-alive connection. zero disables it
+	IdleTimeout time.Duration
+
+	// MaxRequestsPerConn closes a connection after that many requests. zero means unlimited
+	MaxRequestsPerConn int
+	Limits             request.Limits
+	// StreamRequestBody calls the handler once the headers are parsed and leaves
+	// the body in req.BodyReader
+	StreamRequestBody bool
+
+	Logger *log.Logger
+	// ServerName is sent in the Server header of every response the handler doesn't
+	// set one on. empty sends none
+	ServerName string
+	// ErrorHandler answers requests that could not be read. defaults to HandlerError.Write
+	ErrorHandler func(w io.Writer, err *HandlerError)
+	// TLSConfig, when set, makes the server speak TLS on every accepted connection
+	TLSConfig *tls.Config
+	// Certificates are loaded into a CertStore that picks one by SNI and reloads
+	// changed files every CertReloadInterval. they turn TLS on and replace the
+	// certificates of TLSConfig. a zero CertReloadInterval never reloads
+	Certificates       []CertPair
+	CertReloadInterval time.Duration
+	// ClientCAs turns on mutual TLS: every client must present a certificate that
+	// verifies against this pool, and handlers find it in req.Peer
+	ClientCAs *x509.CertPool
+	// ConnStateHook is called every time a connection changes state
+	ConnStateHook func(conn net.Conn, state ConnState)
+	// ContinueHook vets requests sent with "Expect: 100-continue" before the client
+	// sends the body. returning a HandlerError, e.g. a 417 or 413, rejects the request
+	ContinueHook func(req *request.Request) *HandlerError
+	// PanicHook is called with the recovered value and stack trace when a handler panics,
+	// after the panic was logged and answered
+	PanicHook func(req *request.Request, recovered any, stack []byte)
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ReadHeaderTimeout:  defaultReadHeaderTimeout,
+		IdleTimeout:        defaultIdleTimeout,
+		MaxRequestsPerConn: defaultMaxRequestsPerConn,
+		CertReloadInterval: defaultCertReloadInterval,
+		Limits:             request.DefaultLimits,
+		Logger:             log.Default(),
+		ServerName:         defaultServerName,
+		ErrorHandler: func(w io.Writer, err *HandlerError) {
+			err.Write(w)
+		},
+	}
+}
+
+// NewConfig applies cfgs on top of DefaultConfig
+func NewConfig(cfgs ...ServerCfg) Config {
+	config := DefaultConfig()
+	for _, cfg := range cfgs {
+		cfg(&config)
+	}
+	return config
+}
+
+type ConnState int
+
+const (
+	// ConnStateNew is a connection that was just accepted
+	ConnStateNew ConnState = iota
+	// ConnStateIdle is a connection waiting for the next request
+	ConnStateIdle
+	// ConnStateActive is a connection reading, handling or answering a request
+	ConnStateActive
+	// ConnStateClosed is a connection that was closed, it is reported once
+	ConnStateClosed
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case ConnStateNew:
+		return "new"
+	case ConnStateIdle:
+		return "idle"
+	case ConnStateActive:
+		return "active"
+	case ConnStateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ServerCfg configures a Server before it starts accepting connections
+type ServerCfg func(*Config)
+
+// NewAddr sets the address to listen on. "unix://" addresses listen on a unix
+// socket that is removed again when the server stops
+func NewAddr(addr string) ServerCfg {
+	return func(c *Config) {
+		c.Addr = addr
+	}
+}
+
+// NewListener makes the server accept from l instead of listening itself
+func NewListener(l net.Listener) ServerCfg {
+	return func(c *Config) {
+		c.Listener = l
+	}
+}
+
+// NewReadHeaderTimeout sets how long a client may take to send the request line
+// and headers once the first byte arrived, so slow clients can't hold a connection.
+// zero falls back to the read timeout
+func NewReadHeaderTimeout(d time.Duration) ServerCfg {
+	return func(c *Config) {
+		c.ReadHeaderTimeout = d
+	}
+}
+
+// NewReadTimeout sets how long reading a whole request, body included, may take.
+// zero disables the timeout
+func NewReadTimeout(d time.Duration) ServerCfg {
+	return func(c *Config) {
+		c.ReadTimeout = d
+	}
+}
+
+// NewWriteTimeout sets how long writing a response may take.
+// zero disables the timeout
+func NewWriteTimeout(d time.Duration) ServerCfg {
+	return func(c *Config) {
+		c.WriteTimeout = d
+	}
+}
+
+// NewIdleTimeout sets how long a keep-alive connection may wait for the next request.
+// zero disables the timeout
+func NewIdleTimeout(d time.Duration) ServerCfg {
+	return func(c *Config) {
+		c.IdleTimeout = d
+	}
+}
+
+// NewMaxRequestsPerConn caps how many requests are served on one connection
+// before it is closed. zero means unlimited
+func NewMaxRequestsPerConn(n int) ServerCfg {
+	return func(c *Config) {
+		c.MaxRequestsPerConn = n
+	}
+}
+
+// NewLimits replaces request.DefaultLimits for every connection.
+// requests over a limit are answered with 414, 431 or 413
+func NewLimits(limits request.Limits) ServerCfg {
+	return func(c *Config) {
+		c.Limits = limits
+	}
+}
+
+// NewStreamRequestBody makes the server call the handler as soon as the headers
+// are parsed. the handler reads the body from req.BodyReader instead of req.Body
+func NewStreamRequestBody() ServerCfg {
+	return func(c *Config) {
+		c.StreamRequestBody = true
+	}
+}
+
+func NewLogger(logger *log.Logger) ServerCfg {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+// NewServerName replaces the Server response header, "" leaves it out
+func NewServerName(name string) ServerCfg {
+	return func(c *Config) {
+		c.ServerName = name
+	}
+}
+
+// NewErrorHandler replaces how requests that could not be read are answered
+func NewErrorHandler(handler func(w io.Writer, err *HandlerError)) ServerCfg {
+	return func(c *Config) {
+		c.ErrorHandler = handler
+	}
+}
+
+func NewTLSConfig(tlsConfig *tls.Config) ServerCfg {
+	return func(c *Config) {
+		c.TLSConfig = tlsConfig
+	}
+}
+
+// NewCertificates serves HTTPS with the given certificate and key files
+func NewCertificates(certs ...CertPair) ServerCfg {
+	return func(c *Config) {
+		c.Certificates = append(c.Certificates, certs...)
+	}
+}
+
+// NewCertReloadInterval sets how often certificate files are checked for changes
+func NewCertReloadInterval(d time.Duration) ServerCfg {
+	return func(c *Config) {
+		c.CertReloadInterval = d
+	}
+}
+
+// NewClientCAs requires clients to present a certificate signed by one of pool's CAs
+func NewClientCAs(pool *x509.CertPool) ServerCfg {
+	return func(c *Config) {
+		c.ClientCAs = pool
+	}
+}
+
+// NewConnStateHook registers a function called on every connection state change
+func NewConnStateHook(hook func(conn net.Conn, state ConnState)) ServerCfg {
+	return func(c *Config) {
+		c.ConnStateHook = hook
+	}
+}
+
+// NewContinueHook registers a function that accepts or rejects requests waiting for 100 Continue
+func NewContinueHook(hook func(req *request.Request) *HandlerError) ServerCfg {
+	return func(c *Config) {
+		c.ContinueHook = hook
+	}
+}
+
+// NewPanicHook registers a function called when a handler panics, e.g. to report it
+func NewPanicHook(hook func(req *request.Request, recovered any, stack []byte)) ServerCfg {
+	return func(c *Config) {
+		c.PanicHook = hook
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"tcpgo/internal/request"
+	"tcpgo/internal/response"
+)
+
+var ErrExpectationFailed = errors.New("unsupported expectation")
+
+// checkExpect looks at the Expect header of a request whose body hasn't been read yet.
+// it reports whether the client waits for 100 Continue, or why the request is rejected:
+// an unknown expectation, a declared body over the limit, or ContinueHook saying no.
+// HTTP/1.0 clients don't know 100 Continue, their expectations are ignored
+func (s *Server) checkExpect(req *request.Request) (bool, error) {
+	expect, exists := req.Headers.Get("Expect")
+	if !exists || !hasBody(req) || !req.RequestLine.ProtoAtLeast(1, 1) {
+		return false, nil
+	}
+	if !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+		return false, ErrExpectationFailed
+	}
+	if contentLength, exists := req.Headers.Get("Content-Length"); exists && s.config.Limits.MaxBodyBytes > 0 {
+		if l, err := strconv.Atoi(contentLength); err == nil && l > s.config.Limits.MaxBodyBytes {
+			return false, request.ErrBodyTooLarge
+		}
+	}
+	if s.config.ContinueHook != nil {
+		if handlerError := s.config.ContinueHook(req); handlerError != nil {
+			return false, handlerError
+		}
+	}
+	return true, nil
+}
+
+func hasBody(req *request.Request) bool {
+	if req.Headers.Has("Transfer-Encoding") {
+		return true
+	}
+	contentLength, _ := req.Headers.Get("Content-Length")
+	l, err := strconv.Atoi(contentLength)
+	return err == nil && l > 0
+}
+
+func writeContinue(w io.Writer) error {
+	if err := response.WriteStatusLine(w, response.StatusContinue); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte("\r\n"))
+	return err
+}
+
+// continueReader holds back 100 Continue until the handler first reads the body,
+// so a handler that answers without the body never makes the client send it
+type continueReader struct {
+	io.ReadCloser
+	conn net.Conn
+	// res is the response of the request, 100 Continue can't follow a flushed one
+	res  *response.Writer
+	sent bool
+}
+
+func (c *continueReader) Read(p []byte) (int, error) {
+	if !c.sent {
+		c.sent = true
+		if c.res == nil || !c.res.Flushed() {
+			if err := writeContinue(c.conn); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return c.ReadCloser.Read(p)
+}
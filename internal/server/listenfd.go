@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// listenFdsStart is the first file descriptor passed by systemd, after stdin, stdout and stderr
+	listenFdsStart = 3
+	// readyFdEnv names the pipe a restarted process writes to once it accepts connections
+	readyFdEnv = "TCPGO_READY_FD"
+)
+
+var ErrNotHandedOver = errors.New("listener can't be handed to another process")
+
+// ListenersFromEnv returns the listeners passed through LISTEN_FDS, either by systemd
+// socket activation or by a parent process calling Server.Restart. it returns nothing
+// when no listener was passed, or when LISTEN_PID names another process.
+// the variables are unset so child processes don't pick the sockets up again
+func ListenersFromEnv() ([]net.Listener, error) {
+	fdsStr := os.Getenv("LISTEN_FDS")
+	if fdsStr == "" {
+		return nil, nil
+	}
+	// LISTEN_PID is set by systemd. Server.Restart can't know the pid of the new
+	// process up front, so it leaves it out
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	fds, err := strconv.Atoi(fdsStr)
+	if err != nil || fds < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fdsStr)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]net.Listener, 0, fds)
+	for i := range fds {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("listener %s: %w", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// NotifyReady tells the process that started this one through Server.Restart that
+// the server is accepting connections, so the old process can start draining.
+// it does nothing when the process wasn't started that way
+func NotifyReady() error {
+	fdStr := os.Getenv(readyFdEnv)
+	if fdStr == "" {
+		return nil
+	}
+	os.Unsetenv(readyFdEnv)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", readyFdEnv, fdStr)
+	}
+	pipe := os.NewFile(uintptr(fd), "ready")
+	defer pipe.Close()
+	_, err = pipe.Write([]byte{1})
+	return err
+}
+
+// Restart starts a new copy of the running binary with the same arguments and hands
+// it the listening socket as fd 3, the way systemd socket activation does. it returns
+// once the new process called NotifyReady, after which the caller shuts this server
+// down so in-flight requests drain while the new process takes new connections
+func (s *Server) Restart(ctx context.Context) (*os.Process, error) {
+	sysConn, ok := s.netListener.(syscall.Conn)
+	if !ok {
+		return nil, ErrNotHandedOver
+	}
+	rawListener, err := sysConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+
+	env := []string{}
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if key == "LISTEN_FDS" || key == "LISTEN_PID" || key == "LISTEN_FDNAMES" || key == readyFdEnv {
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env, "LISTEN_FDS=1", fmt.Sprintf("%s=%d", readyFdEnv, listenFdsStart+1))
+
+	// the raw fd is passed instead of an *os.File: os.StartProcess would put the
+	// socket, which this server still accepts on, into blocking mode
+	var pid int
+	controlErr := rawListener.Control(func(fd uintptr) {
+		pid, err = syscall.ForkExec(exe, os.Args, &syscall.ProcAttr{
+			Env:   env,
+			Files: []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd(), fd, readyWriter.Fd()},
+		})
+	})
+	readyWriter.Close()
+	if controlErr != nil {
+		return nil, controlErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyReader.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			// the pipe closed without a byte, the new process exited or never called NotifyReady
+			process.Kill()
+			process.Wait()
+			return nil, fmt.Errorf("new process did not become ready: %w", err)
+		}
+	case <-ctx.Done():
+		process.Kill()
+		process.Wait()
+		return nil, ctx.Err()
+	}
+
+	// the socket file now belongs to the new process
+	s.socketPath = ""
+	return process, nil
+}
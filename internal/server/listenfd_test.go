@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"tcpgo/internal/request"
+	"tcpgo/internal/response"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// restartHelperEnv makes the test binary act as the process Restart starts instead of running tests.
+// "serve" serves on the inherited listener and calls NotifyReady, "exit" quits without it
+const restartHelperEnv = "TCPGO_TEST_RESTART_HELPER"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(restartHelperEnv) {
+	case "serve":
+		serveInherited()
+	case "exit":
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// serveInherited answers with its pid on the listener passed through LISTEN_FDS
+func serveInherited() {
+	listeners, err := ListenersFromEnv()
+	if err != nil || len(listeners) != 1 {
+		os.Exit(2)
+	}
+	pid := func(w *response.Writer, req *request.Request) {
+		body := fmt.Sprintf("pid %d", os.Getpid())
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(body))))
+		w.WriteBody([]byte(body))
+	}
+	if _, err := ServeListener(listeners[0], pid, NewLogger(log.New(io.Discard, "", 0))); err != nil {
+		os.Exit(3)
+	}
+	if err := NotifyReady(); err != nil {
+		os.Exit(4)
+	}
+	// the parent kills the process once it is done, this only bounds a leak
+	time.Sleep(10 * time.Second)
+	os.Exit(0)
+}
+
+func TestRestart(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := ServeListener(l, helloHandler, NewLogger(log.New(io.Discard, "", 0)))
+	require.NoError(t, err)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// TEST: Restart fails when the new process exits without calling NotifyReady
+	t.Setenv(restartHelperEnv, "exit")
+	_, err = s.Restart(ctx)
+	require.Error(t, err)
+
+	// TEST: Restart returns once the new process is ready, and it serves on the inherited socket
+	t.Setenv(restartHelperEnv, "serve")
+	process, err := s.Restart(ctx)
+	require.NoError(t, err)
+	defer func() {
+		process.Kill()
+		process.Wait()
+	}()
+	require.NoError(t, s.Shutdown(ctx))
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	res := roundTrip(t, conn, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	conn.Close()
+	assert.True(t, strings.HasSuffix(res, fmt.Sprintf("pid %d", process.Pid)), res)
+}
+
+func TestListenersFromEnv(t *testing.T) {
+	// TEST: Nothing is passed without LISTEN_FDS
+	t.Setenv("LISTEN_FDS", "")
+	listeners, err := ListenersFromEnv()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+
+	// TEST: Sockets meant for another process are left alone
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	listeners, err = ListenersFromEnv()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+	assert.Equal(t, "1", os.Getenv("LISTEN_FDS"))
+
+	// TEST: Unparsable LISTEN_FDS is an error, and the variables are still unset
+	for _, fds := range []string{"abc", "-1"} {
+		t.Setenv("LISTEN_FDS", fds)
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		t.Setenv("LISTEN_FDNAMES", "web")
+		_, err = ListenersFromEnv()
+		assert.Error(t, err, fds)
+		for _, name := range []string{"LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES"} {
+			_, set := os.LookupEnv(name)
+			assert.False(t, set, name)
+		}
+	}
+
+	// TEST: The variables are unset once the sockets are picked up
+	t.Setenv("LISTEN_FDS", "0")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDNAMES", "")
+	listeners, err = ListenersFromEnv()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+	for _, name := range []string{"LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES"} {
+		_, set := os.LookupEnv(name)
+		assert.False(t, set, name)
+	}
+}
@@ -0,0 +1,13 @@
+package server
+
+// Middleware wraps a Handler with behavior that runs around it
+type Middleware func(Handler) Handler
+
+// Chain wraps h with mws. the first middleware is the outermost one,
+// so Chain(h, a, b) runs a, then b, then h
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
@@ -1,22 +1,60 @@
 package server
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"tcpgo/internal/headers"
 	"tcpgo/internal/request"
 	"tcpgo/internal/response"
+	"time"
 )
 
-type Handler func(w response.Writer, req *request.Request)
+const shutdownPollInterval = 50 * time.Millisecond
+
+// newConnGracePeriod is how long Shutdown leaves a just accepted connection alone,
+// so a request already on its way is still answered
+const newConnGracePeriod = 5 * time.Second
+
+// maxDrainBytes is how much of a body the handler left unread is discarded to keep
+// the connection. past that it is cheaper to close the connection
+const maxDrainBytes = 256 << 10
+
+// lingerTimeout bounds how long unread request bytes are drained after an error response
+const lingerTimeout = 500 * time.Millisecond
+
+type Handler func(w *response.Writer, req *request.Request)
 type Server struct {
 	listener net.Listener
-	handler  Handler
-	isClosed atomic.Bool
+	// netListener is listener before any TLS wrapping, it is what Restart hands over
+	netListener net.Listener
+	// socketPath is the unix socket file the server created and removes when it stops
+	socketPath string
+	handler    Handler
+	config     Config
+	// certStore serves Config.Certificates, it is closed with the server
+	certStore *CertStore
+	isClosed  atomic.Bool
+	mu        sync.Mutex
+	conns     map[net.Conn]connState
+	// connsClosed is set by Close, connections accepted after it are not tracked
+	connsClosed bool
+}
+
+// connState is a tracked connection's state and when it was entered
+type connState struct {
+	state ConnState
+	since time.Time
 }
 
 type HandlerError struct {
@@ -24,24 +62,120 @@ type HandlerError struct {
 	Code response.StatusCode
 }
 
+func (h *HandlerError) Error() string {
+	return fmt.Sprintf("%d %s", h.Code, h.Msg)
+}
+
 func (h *HandlerError) Write(w io.Writer) {
-	response.WriteStatusLine(w, h.Code)
-	headers := response.NewResponseHeaders(response.NewContentLength(len(h.Msg)), response.NewContentType("text/plain"), response.NewConnection(""))
-	response.WriteHeaders(w, headers)
-	w.Write([]byte(h.Msg))
-	log.Printf("handler error: %s: %v\n", h.Msg, h.Code)
+	res := response.NewWriter(w)
+	h.WriteResponse(res)
+	res.Flush()
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
+// WriteResponse answers with h through res, so the response follows res's Version
+// and Head like any other. the connection is closed afterwards
+func (h *HandlerError) WriteResponse(res *response.Writer) error {
+	res.KeepAlive = false
+	if err := res.WriteStatusLine(h.Code); err != nil {
+		return err
+	}
+	if err := res.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(h.Msg)), response.NewContentType("text/plain"))); err != nil {
+		return err
+	}
+	return res.WriteBody([]byte(h.Msg))
+}
+
+// Serve listens on port with the default configuration adjusted by cfgs
+func Serve(port int, handler Handler, cfgs ...ServerCfg) (*Server, error) {
 	portStr := fmt.Sprintf(":%s", strconv.Itoa(port))
-	l, err := net.Listen("tcp", portStr)
-	if err != nil {
-		return nil, err
+	cfgs = append([]ServerCfg{NewAddr(portStr)}, cfgs...)
+	return ServeConfig(NewConfig(cfgs...), handler)
+}
+
+// ServeTLS listens on port and serves HTTPS with certs, picking one per connection
+// by SNI. certificate files are watched and reloaded when they change
+func ServeTLS(port int, handler Handler, certs []CertPair, cfgs ...ServerCfg) (*Server, error) {
+	if len(certs) == 0 {
+		return nil, ErrNoCertificates
+	}
+	portStr := fmt.Sprintf(":%s", strconv.Itoa(port))
+	cfgs = append([]ServerCfg{NewAddr(portStr)}, cfgs...)
+	cfgs = append(cfgs, NewCertificates(certs...))
+	return ServeConfig(NewConfig(cfgs...), handler)
+}
+
+// ServeListener accepts connections from l, which can be any net.Listener:
+// a unix socket, an inherited file descriptor or an in-memory listener in tests
+func ServeListener(l net.Listener, handler Handler, cfgs ...ServerCfg) (*Server, error) {
+	cfgs = append(cfgs, NewListener(l))
+	return ServeConfig(NewConfig(cfgs...), handler)
+}
+
+// ServeConfig starts accepting connections as described by config and returns right away
+func ServeConfig(config Config, handler Handler) (*Server, error) {
+	var certStore *CertStore
+	if len(config.Certificates) > 0 {
+		var err error
+		certStore, err = NewCertStore(config.Certificates...)
+		if err != nil {
+			return nil, err
+		}
+		config.TLSConfig = withCertStore(config.TLSConfig, certStore)
+	}
+	if config.ClientCAs != nil {
+		if config.TLSConfig == nil {
+			return nil, errors.New("client CAs need TLS: set Certificates or TLSConfig")
+		}
+		config.TLSConfig = withClientCAs(config.TLSConfig, config.ClientCAs)
+	}
+	if config.TLSConfig != nil {
+		config.TLSConfig = withHTTP1(config.TLSConfig)
+	}
+
+	l := config.Listener
+	socketPath := ""
+	if l == nil {
+		network, address := parseAddr(config.Addr)
+		if network == "unix" {
+			if err := removeStaleSocket(address); err != nil {
+				return nil, err
+			}
+			socketPath = address
+		}
+		var err error
+		l, err = net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		if unixListener, ok := l.(*net.UnixListener); ok {
+			// the server removes the file itself, see Server.removeSocket
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	netListener := l
+	if config.TLSConfig != nil {
+		l = tls.NewListener(l, config.TLSConfig)
+	}
+	if config.Logger == nil {
+		config.Logger = log.Default()
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = func(w io.Writer, err *HandlerError) {
+			err.Write(w)
+		}
 	}
 
 	server := &Server{
-		listener: l,
-		handler:  handler,
+		listener:    l,
+		netListener: netListener,
+		socketPath:  socketPath,
+		handler:     handler,
+		config:      config,
+		conns:       map[net.Conn]connState{},
+		certStore:   certStore,
+	}
+	if certStore != nil && config.CertReloadInterval > 0 {
+		certStore.Watch(config.CertReloadInterval, config.Logger)
 	}
 
 	go server.listen()
@@ -49,12 +183,125 @@ func Serve(port int, handler Handler) (*Server, error) {
 	return server, nil
 }
 
+// Addr returns the address the server accepts connections on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops accepting and closes every connection right away,
+// including those still serving a request. see Shutdown for a graceful stop
 func (s *Server) Close() error {
 	s.isClosed.Store(true)
+	err := s.closeListener()
+
+	s.mu.Lock()
+	s.connsClosed = true
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+		delete(s.conns, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+		s.connStateHook(conn, ConnStateClosed)
+	}
+	return err
+}
+
+// Shutdown stops accepting connections, closes idle ones and waits for in-flight
+// requests to be answered. connections still open when ctx is done are closed
+// and ctx's error is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.isClosed.Store(true)
+	err := s.closeListener()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) closeListener() error {
+	var err error
 	if s.listener != nil {
-		return s.listener.Close()
+		err = s.listener.Close()
+	}
+	if s.certStore != nil {
+		s.certStore.Close()
+	}
+	s.removeSocket()
+	return err
+}
+
+func (s *Server) removeSocket() {
+	if s.socketPath == "" {
+		return
+	}
+	if err := os.Remove(s.socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.config.Logger.Printf("could not remove socket %s: %v\n", s.socketPath, err)
+	}
+	s.socketPath = ""
+}
+
+// closeIdleConns closes connections waiting for a request and reports whether none are left.
+// new connections are only closed once they had newConnGracePeriod to send their request
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	idle := []net.Conn{}
+	for conn, cs := range s.conns {
+		if cs.state == ConnStateIdle || cs.state == ConnStateNew && time.Since(cs.since) >= newConnGracePeriod {
+			idle = append(idle, conn)
+			delete(s.conns, conn)
+		}
+	}
+	left := len(s.conns)
+	s.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.Close()
+		s.connStateHook(conn, ConnStateClosed)
+	}
+	return left == 0
+}
+
+// setConnState records state for conn and reports whether conn is tracked. only new
+// connections are added, so one that Close or Shutdown already closed and reported
+// stays out and is not reported again
+func (s *Server) setConnState(conn net.Conn, state ConnState) bool {
+	s.mu.Lock()
+	_, tracked := s.conns[conn]
+	if state == ConnStateNew {
+		tracked = !s.connsClosed
+	}
+	if tracked {
+		if state == ConnStateClosed {
+			delete(s.conns, conn)
+		} else {
+			s.conns[conn] = connState{state: state, since: time.Now()}
+		}
+	}
+	s.mu.Unlock()
+	if tracked {
+		s.connStateHook(conn, state)
+	}
+	return tracked
+}
+
+func (s *Server) connStateHook(conn net.Conn, state ConnState) {
+	if s.config.ConnStateHook != nil {
+		s.config.ConnStateHook(conn, state)
 	}
-	return nil
 }
 
 func (s *Server) listen() {
@@ -64,31 +311,324 @@ func (s *Server) listen() {
 			if s.isClosed.Load() {
 				return
 			}
-			log.Printf("could not accept connection: %s\n", err)
+			s.config.Logger.Printf("could not accept connection: %s\n", err)
 			continue
 		}
 
+		if !s.setConnState(conn, ConnStateNew) {
+			// accepted while Close ran
+			conn.Close()
+			continue
+		}
 		go s.handle(conn)
 	}
 }
 
 func (s *Server) handle(conn net.Conn) {
+	defer s.setConnState(conn, ConnStateClosed)
 	defer conn.Close()
-	req, err := request.RequestFromReader(conn)
+	var peer *request.PeerIdentity
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := s.handshake(tlsConn); err != nil {
+			s.config.Logger.Printf("TLS handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+		peer = request.NewPeerIdentity(tlsConn.ConnectionState().VerifiedChains)
+	}
+
+	requestReader := request.NewReader(conn)
+	requestReader.Limits = s.config.Limits
+	for served := 1; ; served++ {
+		// the first request is still answered, the client might have sent it before Shutdown
+		if served > 1 && s.isClosed.Load() {
+			return
+		}
+		// pipelined requests are already buffered in requestReader and are answered in order
+		if requestReader.Buffered() == 0 {
+			if served > 1 {
+				s.setConnState(conn, ConnStateIdle)
+			}
+			setDeadline(conn.SetReadDeadline, s.config.IdleTimeout)
+			if err := requestReader.Wait(); err != nil {
+				// client went away, stayed idle for too long or the server is shutting down
+				return
+			}
+		}
+		s.setConnState(conn, ConnStateActive)
+
+		req, err := s.readRequest(conn, requestReader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || s.isClosed.Load() {
+				return
+			}
+			handlerError := readError(err)
+			setDeadline(conn.SetWriteDeadline, s.config.WriteTimeout)
+			s.config.ErrorHandler(conn, handlerError)
+			s.config.Logger.Printf("handler error: %s: %v\n", handlerError.Msg, handlerError.Code)
+			lingerClose(conn)
+			return
+		}
+
+		req.Peer = peer
+
+		setDeadline(conn.SetWriteDeadline, s.config.WriteTimeout)
+		res := response.NewWriter(conn)
+		res.KeepAlive = s.keepAlive(req, served)
+		res.OnHeaders(func(h *headers.Headers) {
+			if s.isClosed.Load() {
+				// Shutdown started while the handler ran
+				h.Set("Connection", "close")
+			}
+		})
+		res.ServerName = s.config.ServerName
+		res.Head = req.RequestLine.Method == "HEAD"
+		if !req.RequestLine.ProtoAtLeast(1, 1) {
+			res.Version = "1.0"
+		}
+		body, waitsForContinue := req.BodyReader.(*continueReader)
+		if waitsForContinue {
+			body.res = res
+			res.OnHeaders(func(h *headers.Headers) {
+				if !body.sent {
+					// the client never got to send the body, so it can't be skipped to reach the next request
+					h.Set("Connection", "close")
+				}
+			})
+		}
+		if !s.serveRequest(res, req) {
+			return
+		}
+		if err := res.Finish(); err != nil {
+			s.config.Logger.Printf("could not finish response: %v\n", err)
+			return
+		}
+		if err := res.Flush(); err != nil {
+			return
+		}
+		if !res.KeepAlive {
+			if requestReader.Buffered() > 0 {
+				// pipelined requests that won't be answered would turn the close into a reset
+				lingerClose(conn)
+			}
+			return
+		}
+		if req.BodyReader != nil {
+			// whatever the handler left unread has to go before the next request
+			n, err := io.CopyN(io.Discard, req.BodyReader, maxDrainBytes+1)
+			if n > maxDrainBytes || err != nil && !errors.Is(err, io.EOF) {
+				return
+			}
+			if err := req.BodyReader.Close(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveRequest runs the handler and recovers from a panic in it. the client gets a 500
+// when nothing was flushed yet, otherwise the response is cut off. either way the
+// connection is not reused and serveRequest reports false
+func (s *Server) serveRequest(res *response.Writer, req *request.Request) (ok bool) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		ok = false
+		stack := debug.Stack()
+		s.config.Logger.Printf("panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, recovered, stack)
+		if err := res.ResetBuffer(); err == nil {
+			handlerError := &HandlerError{Msg: "internal server error", Code: response.StatusInternalServerError}
+			if err := handlerError.WriteResponse(res); err == nil {
+				res.Flush()
+			}
+		} else {
+			res.Abort()
+		}
+		if s.config.PanicHook != nil {
+			s.config.PanicHook(req, recovered, stack)
+		}
+	}()
+	s.handler(res, req)
+	return true
+}
+
+// handshake completes the TLS handshake within the header timeout, so a broken or
+// stalled handshake never reaches the request parser
+func (s *Server) handshake(conn *tls.Conn) error {
+	timeout := s.config.ReadHeaderTimeout
+	if timeout == 0 {
+		timeout = s.config.ReadTimeout
+	}
+	setDeadline(conn.SetDeadline, timeout)
+	defer conn.SetDeadline(time.Time{})
+	return conn.Handshake()
+}
+
+// readRequest reads the headers within ReadHeaderTimeout and, unless the body is
+// streamed to the handler, the body within what is left of ReadTimeout
+func (s *Server) readRequest(conn net.Conn, requestReader *request.Reader) (*request.Request, error) {
+	start := time.Now()
+	headerTimeout := s.config.ReadHeaderTimeout
+	if headerTimeout == 0 {
+		headerTimeout = s.config.ReadTimeout
+	}
+	setDeadline(conn.SetReadDeadline, headerTimeout)
+
+	req, err := requestReader.ReadRequestStream()
 	if err != nil {
-		handlerError := &HandlerError{
-			Msg:  fmt.Sprintf("could not parse request: %v", err),
-			Code: response.StatusBadRequest,
+		return nil, err
+	}
+
+	if s.config.ReadTimeout > 0 {
+		conn.SetReadDeadline(start.Add(s.config.ReadTimeout))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+		if req.BodyReader != nil && s.config.ReadHeaderTimeout > 0 {
+			// without ReadTimeout the body still has to keep coming
+			req.BodyReader = &progressReader{ReadCloser: req.BodyReader, conn: conn, timeout: s.config.ReadHeaderTimeout}
 		}
-		handlerError.Write(conn)
+	}
+	expectsContinue, err := s.checkExpect(req)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.StreamRequestBody {
+		if expectsContinue {
+			req.BodyReader = &continueReader{ReadCloser: req.BodyReader, conn: conn}
+		}
+		return req, nil
+	}
+	if expectsContinue {
+		if err := writeContinue(conn); err != nil {
+			return nil, err
+		}
+	}
+	if err := req.ReadBody(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// readError picks the response for a request that could not be read
+func readError(err error) *HandlerError {
+	var handlerError *HandlerError
+	switch {
+	case errors.As(err, &handlerError):
+		return handlerError
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return &HandlerError{Msg: err.Error(), Code: response.StatusHTTPVersionNotSupported}
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return &HandlerError{Msg: err.Error(), Code: response.StatusNotImplemented}
+	case errors.Is(err, ErrExpectationFailed):
+		return &HandlerError{Msg: err.Error(), Code: response.StatusExpectationFailed}
+	case isTimeout(err):
+		return &HandlerError{Msg: "timed out reading request", Code: response.StatusRequestTimeout}
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		return &HandlerError{Msg: err.Error(), Code: response.StatusURITooLong}
+	case errors.Is(err, request.ErrHeadersTooLarge):
+		return &HandlerError{Msg: err.Error(), Code: response.StatusHeaderFieldsTooLarge}
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return &HandlerError{Msg: err.Error(), Code: response.StatusContentTooLarge}
+	default:
+		return &HandlerError{Msg: fmt.Sprintf("could not parse request: %v", err), Code: response.StatusBadRequest}
+	}
+}
+
+// parseAddr splits addresses like "unix:///run/app.sock" or "tcp://:42069" into
+// a network and an address for net.Listen. a bare address is TCP
+func parseAddr(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return "unix", path
+	}
+	if hostPort, ok := strings.CutPrefix(addr, "tcp://"); ok {
+		return "tcp", hostPort
+	}
+	return "tcp", addr
+}
+
+// removeStaleSocket deletes a socket file left behind by a server that didn't stop cleanly.
+// a socket something still listens on, or anything that isn't a socket, is left alone
+// and net.Listen reports the conflict
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// setDeadline sets a deadline d from now, or clears it when d is zero
+func setDeadline(set func(time.Time) error, d time.Duration) {
+	if d > 0 {
+		set(time.Now().Add(d))
 		return
 	}
+	set(time.Time{})
+}
 
-	buffer := bytes.NewBuffer([]byte{})
-	res := response.Writer{
-		Buffer:      buffer,
-		WriterState: 0,
+// progressReader gives every read of a body timeout to get data from conn
+type progressReader struct {
+	io.ReadCloser
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	p.conn.SetReadDeadline(time.Now().Add(p.timeout))
+	return p.ReadCloser.Read(b)
+}
+
+// keepAlive reports whether the connection may be reused after answering req
+func (s *Server) keepAlive(req *request.Request, served int) bool {
+	if s.isClosed.Load() {
+		return false
 	}
-	s.handler(res, req)
-	conn.Write(res.Buffer.Bytes())
+	if s.config.MaxRequestsPerConn > 0 && served >= s.config.MaxRequestsPerConn {
+		return false
+	}
+	if !req.RequestLine.ProtoAtLeast(1, 1) && req.Headers.Has("Transfer-Encoding") {
+		// an HTTP/1.0 hop may not have framed the body the same way, so what follows
+		// can't be trusted to be the next request (RFC 9112 section 6.1)
+		return false
+	}
+	// close wins over any other token. HTTP/1.1 connections stay open otherwise,
+	// HTTP/1.0 ones only when the client asks for keep-alive
+	connection, _ := req.Headers.Get("connection")
+	keepAlive := false
+	for _, token := range strings.Split(connection, ",") {
+		token = strings.TrimSpace(token)
+		if strings.EqualFold(token, "close") {
+			return false
+		}
+		if strings.EqualFold(token, "keep-alive") {
+			keepAlive = true
+		}
+	}
+	return keepAlive || req.RequestLine.ProtoAtLeast(1, 1)
+}
+
+// lingerClose half-closes conn and drains what the client still sends for a moment,
+// so unread request bytes don't turn the close into a reset that discards the response
+func lingerClose(conn net.Conn) {
+	if closeWriter, ok := conn.(interface{ CloseWrite() error }); ok {
+		closeWriter.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(lingerTimeout))
+	io.Copy(io.Discard, conn)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
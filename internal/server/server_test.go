@@ -0,0 +1,701 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"tcpgo/internal/request"
+	"tcpgo/internal/response"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func helloHandler(w *response.Writer, req *request.Request) {
+	body := "hello " + req.RequestLine.RequestTarget
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(body))))
+	w.WriteBody([]byte(body))
+}
+
+// roundTrip writes raw to conn and reads everything until the server closes it
+func roundTrip(t *testing.T, conn net.Conn, raw string) string {
+	t.Helper()
+	_, err := conn.Write([]byte(raw))
+	require.NoError(t, err)
+	res, err := io.ReadAll(bufio.NewReader(conn))
+	require.NoError(t, err)
+	return string(res)
+}
+
+func TestServeListener(t *testing.T) {
+	// TEST: Caller-supplied listener, pipelined requests answered in order
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := ServeListener(l, helloHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	res := roundTrip(t, conn, "GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, res, "Connection: keep-alive\r\n")
+	assert.Contains(t, res, "Connection: close\r\n")
+	assert.Contains(t, res, "Server: tcpgo\r\n")
+	assert.Contains(t, res, "Date: ")
+	assert.Regexp(t, "(?s)hello /a.*hello /b$", res)
+}
+
+func TestTruncatedRequest(t *testing.T) {
+	var served atomic.Int32
+	counting := func(w *response.Writer, req *request.Request) {
+		served.Add(1)
+		helloHandler(w, req)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := ServeListener(l, counting, NewLogger(log.New(io.Discard, "", 0)))
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, raw := range []string{"GET / HTTP/1.1\r\nHost: x", "GARBAGE", "GET / HTTP/1.1\r\n\r\nGET /next HTTP/1.1\r\nHost: x"} {
+		// TEST: A request cut short by the client's half-close never reaches the handler
+		served.Store(0)
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte(raw))
+		require.NoError(t, err)
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+		res, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		conn.Close()
+		complete := strings.Count(raw, "\r\n\r\n")
+		assert.Equal(t, int32(complete), served.Load(), raw)
+		assert.Equal(t, complete, strings.Count(string(res), "HTTP/1.1 200 OK"), raw)
+		assert.Contains(t, string(res), "HTTP/1.1 400 Bad Request\r\n", raw)
+	}
+}
+
+func TestHTTP10(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := ServeListener(l, helloHandler, NewLogger(log.New(io.Discard, "", 0)))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// TEST: HTTP/1.0 closes after the response by default
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	res := roundTrip(t, conn, "GET /old HTTP/1.0\r\n\r\n")
+	conn.Close()
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.0 200 OK\r\n"))
+	assert.Contains(t, res, "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(res, "hello /old"))
+
+	// TEST: HTTP/1.0 keep-alive is opt-in
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	res = roundTrip(t, conn, "GET /a HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET /b HTTP/1.0\r\n\r\n")
+	conn.Close()
+	assert.Contains(t, res, "Connection: keep-alive\r\n")
+	assert.Regexp(t, "(?s)hello /a.*HTTP/1.0 200 OK.*hello /b$", res)
+
+	// TEST: close wins over keep-alive in the same header, whatever the order
+	for _, connection := range []string{"keep-alive, close", "close, keep-alive"} {
+		for _, version := range []string{"1.0", "1.1"} {
+			conn, err = net.Dial("tcp", s.Addr().String())
+			require.NoError(t, err)
+			res = roundTrip(t, conn, "GET /c HTTP/"+version+"\r\nConnection: "+connection+"\r\n\r\n")
+			conn.Close()
+			assert.Contains(t, res, "Connection: close\r\n", connection)
+			assert.NotContains(t, res, "keep-alive", connection)
+		}
+	}
+
+	// TEST: HTTP/1.0 with Transfer-Encoding is closed after the response, keep-alive or not
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	res = roundTrip(t, conn, "POST /a HTTP/1.0\r\nTransfer-Encoding: chunked\r\nConnection: keep-alive\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.0\r\n\r\n")
+	conn.Close()
+	assert.Contains(t, res, "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(res, "hello /a"))
+	assert.NotContains(t, res, "smuggled")
+
+	// TEST: Other major versions get 505
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	res = roundTrip(t, conn, "GET / HTTP/2.0\r\n\r\n")
+	conn.Close()
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 505 HTTP Version Not Supported\r\n"))
+}
+
+func TestHeadRequest(t *testing.T) {
+	// TEST: HEAD gets the GET headers, computed Content-Length included, and no body
+	unframed := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.NewResponseHeaders(response.NewContentType("text/plain")))
+		w.WriteBody([]byte("hello " + req.RequestLine.Method))
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := ServeListener(l, unframed)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	res := roundTrip(t, conn, "HEAD / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	head, get, found := strings.Cut(res, "\r\n\r\n")
+	require.True(t, found)
+	assert.True(t, strings.HasSuffix(head, "Content-Length: 10"))
+	assert.Contains(t, head, "Connection: keep-alive\r\n")
+	assert.True(t, strings.HasPrefix(get, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, get, "Content-Length: 9\r\n")
+	assert.True(t, strings.HasSuffix(get, "\r\n\r\nhello GET"))
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	// TEST: unix:// address serves requests and removes the socket on shutdown
+	path := filepath.Join(t.TempDir(), "tcpgo.sock")
+	s, err := ServeConfig(NewConfig(NewAddr("unix://"+path)), helloHandler)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	res := roundTrip(t, conn, "GET /unix HTTP/1.1\r\nConnection: close\r\n\r\n")
+	conn.Close()
+	assert.Contains(t, res, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, res, "hello /unix")
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// TEST: A stale socket file from a previous run is replaced
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	s, err = ServeConfig(NewConfig(NewAddr("unix://"+path)), helloHandler)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	panicking := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/flushed" {
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.NewResponseHeaders(response.NewTransferEncoding("chunked")))
+			w.WriteChunkedBody([]byte("partial"))
+			w.Flush()
+		}
+		panic("boom")
+	}
+	var logs bytes.Buffer
+	reported := make(chan any, 2)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := ServeListener(l, panicking, NewLogger(log.New(&logs, "", 0)), NewPanicHook(func(req *request.Request, recovered any, stack []byte) {
+		reported <- recovered
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// TEST: Panic before anything was flushed is a 500 and the server keeps running
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	res := roundTrip(t, conn, "GET /panic HTTP/1.1\r\n\r\n")
+	conn.Close()
+	assert.Contains(t, res, "HTTP/1.1 500 Internal Server Error\r\n")
+	assert.Contains(t, res, "Connection: close\r\n")
+	assert.Equal(t, "boom", <-reported)
+
+	// TEST: The 500 follows the request's version, and HEAD gets it without a body
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	res = roundTrip(t, conn, "GET /panic HTTP/1.0\r\n\r\n")
+	conn.Close()
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.0 500 Internal Server Error\r\n"), res)
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\ninternal server error"), res)
+	assert.Equal(t, "boom", <-reported)
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	res = roundTrip(t, conn, "HEAD /panic HTTP/1.1\r\n\r\n")
+	conn.Close()
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 500 Internal Server Error\r\n"), res)
+	assert.Contains(t, res, "Content-Length: 21\r\n")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\n"), res)
+	assert.Equal(t, "boom", <-reported)
+
+	// TEST: Panic after a flush cuts the response off without the terminating chunk
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	res = roundTrip(t, conn, "GET /flushed HTTP/1.1\r\n\r\n")
+	conn.Close()
+	assert.Contains(t, res, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, res, "7\r\npartial\r\n")
+	assert.NotContains(t, res, "0\r\n\r\n")
+	assert.Equal(t, "boom", <-reported)
+	assert.Contains(t, logs.String(), "panic serving GET /flushed: boom")
+}
+
+func TestExpectContinue(t *testing.T) {
+	echo := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/ignore" {
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(0)))
+			return
+		}
+		if req.BodyReader != nil {
+			req.ReadBody()
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(req.Body))))
+		w.WriteBody(req.Body)
+	}
+	hook := func(req *request.Request) *HandlerError {
+		if _, exists := req.Headers.Get("X-Reject"); exists {
+			return &HandlerError{Msg: "rejected", Code: response.StatusExpectationFailed}
+		}
+		return nil
+	}
+	for _, streaming := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		cfgs := []ServerCfg{NewContinueHook(hook), NewLogger(log.New(io.Discard, "", 0))}
+		if streaming {
+			cfgs = append(cfgs, NewStreamRequestBody())
+		}
+		s, err := ServeListener(l, echo, cfgs...)
+		require.NoError(t, err)
+
+		// TEST: 100 Continue goes out before the body is sent
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 5\r\nExpect: 100-continue\r\nConnection: close\r\n\r\n"))
+		require.NoError(t, err)
+		reader := bufio.NewReader(conn)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+		line, err = reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "\r\n", line)
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		res, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(res), "HTTP/1.1 200 OK\r\n"))
+		assert.True(t, strings.HasSuffix(string(res), "\r\n\r\nhello"))
+		conn.Close()
+
+		// TEST: The hook rejects before the body is sent
+		conn, err = net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		out := roundTrip(t, conn, "POST / HTTP/1.1\r\nContent-Length: 5\r\nExpect: 100-continue\r\nX-Reject: yes\r\n\r\n")
+		conn.Close()
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 417 Expectation Failed\r\n"))
+		assert.NotContains(t, out, "100 Continue")
+
+		// TEST: Unknown expectations and bodies over the limit are rejected
+		conn, err = net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		out = roundTrip(t, conn, "POST / HTTP/1.1\r\nContent-Length: 5\r\nExpect: something-else\r\n\r\n")
+		conn.Close()
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 417 Expectation Failed\r\n"))
+		conn, err = net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		out = roundTrip(t, conn, "POST / HTTP/1.1\r\nContent-Length: 999999999\r\nExpect: 100-continue\r\n\r\n")
+		conn.Close()
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"))
+
+		if streaming {
+			// TEST: A handler that never reads the body answers without 100 Continue and closes
+			conn, err = net.Dial("tcp", s.Addr().String())
+			require.NoError(t, err)
+			out = roundTrip(t, conn, "POST /ignore HTTP/1.1\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+			conn.Close()
+			assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+			assert.Contains(t, out, "Connection: close\r\n")
+		}
+		s.Close()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	blocking := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		helloHandler(w, req)
+	}
+	states := make(chan ConnState, 16)
+	serve := func() *Server {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		s, err := ServeListener(l, blocking, NewLogger(log.New(io.Discard, "", 0)), NewConnStateHook(func(conn net.Conn, state ConnState) {
+			states <- state
+		}))
+		require.NoError(t, err)
+		return s
+	}
+	waitState := func(want ConnState) {
+		t.Helper()
+		for {
+			select {
+			case state := <-states:
+				if state == want {
+					return
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("connection never got to %v", want)
+			}
+		}
+	}
+
+	// TEST: An in-flight request is answered with Connection: close before Shutdown returns
+	s := serve()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	done := make(chan error)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	for !s.isClosed.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	res, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	conn.Close()
+	assert.Contains(t, string(res), "Connection: close\r\n")
+	assert.NotContains(t, string(res), "keep-alive")
+	assert.True(t, strings.HasSuffix(string(res), "hello /slow"))
+	require.NoError(t, <-done)
+
+	// TEST: Idle keep-alive connections are closed right away
+	s = serve()
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET /a HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	waitState(ConnStateIdle)
+	require.NoError(t, s.Shutdown(context.Background()))
+	res, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	conn.Close()
+	assert.Contains(t, string(res), "Connection: keep-alive\r\n")
+	assert.True(t, strings.HasSuffix(string(res), "hello /a"))
+
+	// TEST: A just accepted connection still gets its first request answered
+	s = serve()
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	waitState(ConnStateNew)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	for !s.isClosed.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	got := roundTrip(t, conn, "GET /late HTTP/1.1\r\n\r\n")
+	conn.Close()
+	assert.Contains(t, got, "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(got, "hello /late"))
+	require.NoError(t, <-done)
+
+	// TEST: Connections still busy when ctx expires are closed and ctx's error returned
+	release = make(chan struct{})
+	defer close(release)
+	s = serve()
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	res, _ = io.ReadAll(conn)
+	assert.Empty(t, res)
+}
+
+func TestTimeouts(t *testing.T) {
+	var served atomic.Int32
+	counting := func(w *response.Writer, req *request.Request) {
+		served.Add(1)
+		helloHandler(w, req)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := ServeListener(l, counting, NewLogger(log.New(io.Discard, "", 0)),
+		NewReadHeaderTimeout(100*time.Millisecond), NewReadTimeout(200*time.Millisecond), NewIdleTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// TEST: Headers that stall past ReadHeaderTimeout get 408
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	res := roundTrip(t, conn, "GET / HTTP/1.1\r\nHost: x")
+	conn.Close()
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 408 Request Timeout\r\n"), res)
+	assert.Equal(t, int32(0), served.Load())
+
+	// TEST: ReadTimeout covers the body, a body that stalls gets 408 and never reaches the handler
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	start := time.Now()
+	res = roundTrip(t, conn, "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nab")
+	conn.Close()
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 408 Request Timeout\r\n"), res)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	assert.Equal(t, int32(0), served.Load())
+
+	// TEST: A keep-alive connection is closed once it sits idle past IdleTimeout
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	start = time.Now()
+	res = roundTrip(t, conn, "GET /a HTTP/1.1\r\n\r\n")
+	conn.Close()
+	assert.Contains(t, res, "Connection: keep-alive\r\n")
+	assert.True(t, strings.HasSuffix(res, "hello /a"))
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, int32(1), served.Load())
+
+	// TEST: Without ReadTimeout a body that stops coming still times out after ReadHeaderTimeout
+	served.Store(0)
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	noReadTimeout, err := ServeListener(l, counting, NewLogger(log.New(io.Discard, "", 0)), NewReadHeaderTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	defer noReadTimeout.Close()
+	conn, err = net.Dial("tcp", noReadTimeout.Addr().String())
+	require.NoError(t, err)
+	res = roundTrip(t, conn, "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nab")
+	conn.Close()
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 408 Request Timeout\r\n"), res)
+	assert.Equal(t, int32(0), served.Load())
+}
+
+func TestUnreadBody(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := ServeListener(l, helloHandler, NewStreamRequestBody(), NewLogger(log.New(io.Discard, "", 0)))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// TEST: A small body the handler ignores is discarded and the connection reused
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	res := roundTrip(t, conn, "POST /a HTTP/1.1\r\nContent-Length: 1024\r\n\r\n"+strings.Repeat("x", 1024)+"GET /b HTTP/1.1\r\nConnection: close\r\n\r\n")
+	conn.Close()
+	assert.Regexp(t, "(?s)hello /a.*hello /b$", res)
+
+	// TEST: A body past maxDrainBytes is not read to the end, the connection is closed instead
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	go func() {
+		// the server stops reading, so this write fails partway
+		conn.Write([]byte(fmt.Sprintf("POST /big HTTP/1.1\r\nContent-Length: %d\r\n\r\n", 4*maxDrainBytes)))
+		conn.Write(bytes.Repeat([]byte("x"), 4*maxDrainBytes))
+	}()
+	reader := bufio.NewReader(conn)
+	first := readResponse(t, reader)
+	assert.True(t, strings.HasSuffix(first, "hello /big"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = reader.ReadByte()
+	require.Error(t, err)
+	assert.False(t, isTimeout(err), "connection was kept open: %v", err)
+}
+
+// readResponse reads one Content-Length framed response off reader
+func readResponse(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+	var res strings.Builder
+	length := 0
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		res.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			require.NoError(t, err)
+		}
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(reader, body)
+	require.NoError(t, err)
+	res.Write(body)
+	return res.String()
+}
+
+func TestKeepAlive(t *testing.T) {
+	var conns atomic.Int32
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := ServeListener(l, helloHandler, NewMaxRequestsPerConn(3), NewConnStateHook(func(conn net.Conn, state ConnState) {
+		if state == ConnStateNew {
+			conns.Add(1)
+		}
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// TEST: Requests sent one after the other share a connection, the Nth gets Connection: close
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	for i, path := range []string{"/1", "/2", "/3"} {
+		_, err = conn.Write([]byte("GET " + path + " HTTP/1.1\r\n\r\n"))
+		require.NoError(t, err)
+		res := readResponse(t, reader)
+		assert.True(t, strings.HasSuffix(res, "hello "+path))
+		if i < 2 {
+			assert.Contains(t, res, "Connection: keep-alive\r\n", path)
+		} else {
+			assert.Contains(t, res, "Connection: close\r\n", path)
+		}
+	}
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	conn.Close()
+	assert.Equal(t, int32(1), conns.Load())
+
+	// TEST: The client's Connection: close is honoured
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	reader = bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET /bye HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	res := readResponse(t, reader)
+	assert.Contains(t, res, "Connection: close\r\n")
+	assert.True(t, strings.HasSuffix(res, "hello /bye"))
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	conn.Close()
+}
+
+func TestLimits(t *testing.T) {
+	var served atomic.Int32
+	counting := func(w *response.Writer, req *request.Request) {
+		served.Add(1)
+		helloHandler(w, req)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	limits := request.Limits{MaxRequestLineBytes: 64, MaxHeaderBytes: 128, MaxHeaderCount: 4, MaxBodyBytes: 16}
+	s, err := ServeListener(l, counting, NewLimits(limits), NewLogger(log.New(io.Discard, "", 0)))
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name   string
+		raw    string
+		status string
+	}{
+		{"long request line", "GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\n\r\n", "HTTP/1.1 414 URI Too Long\r\n"},
+		{"large headers", "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("b", 200) + "\r\n\r\n", "HTTP/1.1 431 Request Header Fields Too Large\r\n"},
+		{"many headers", "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\nE: 5\r\n\r\n", "HTTP/1.1 431 Request Header Fields Too Large\r\n"},
+		{"encoded body", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", "HTTP/1.1 501 Not Implemented\r\n"},
+		{"large body", "POST / HTTP/1.1\r\nContent-Length: 32\r\n\r\n" + strings.Repeat("c", 32), "HTTP/1.1 413 Content Too Large\r\n"},
+		{"large chunked body", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n20\r\n" + strings.Repeat("c", 32) + "\r\n0\r\n\r\n", "HTTP/1.1 413 Content Too Large\r\n"},
+	} {
+		// TEST: Each limit, and a body coding other than chunked, gets its own status and never reaches the handler
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		res := roundTrip(t, conn, tc.raw)
+		conn.Close()
+		assert.True(t, strings.HasPrefix(res, tc.status), "%s: %q", tc.name, res)
+		assert.Contains(t, res, "Connection: close\r\n", tc.name)
+	}
+	assert.Equal(t, int32(0), served.Load())
+
+	// TEST: Requests right at the limits are served
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	res := roundTrip(t, conn, "POST /ok HTTP/1.1\r\nContent-Length: 16\r\nConnection: close\r\n\r\n"+strings.Repeat("d", 16))
+	conn.Close()
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"), res)
+	assert.Equal(t, int32(1), served.Load())
+}
+
+func TestConnState(t *testing.T) {
+	var mu sync.Mutex
+	closed := map[net.Conn]int{}
+	hook := func(conn net.Conn, state ConnState) {
+		if state == ConnStateClosed {
+			mu.Lock()
+			closed[conn]++
+			mu.Unlock()
+		}
+	}
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	blocking := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		helloHandler(w, req)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s, err := ServeListener(l, blocking, NewLogger(log.New(io.Discard, "", 0)), NewConnStateHook(hook))
+	require.NoError(t, err)
+
+	// TEST: Connections closed by Close are reported once, even when their handler returns afterwards
+	active, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer active.Close()
+	_, err = active.Write([]byte("GET /slow HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	idle, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+	require.NoError(t, s.Close())
+	close(release)
+	io.ReadAll(active)
+	io.ReadAll(idle)
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	assert.Len(t, closed, 2)
+	for _, count := range closed {
+		assert.Equal(t, 1, count)
+	}
+	mu.Unlock()
+
+	// TEST: A state change after Close doesn't track the connection again
+	client, server := net.Pipe()
+	defer client.Close()
+	assert.False(t, s.setConnState(server, ConnStateNew))
+	assert.False(t, s.setConnState(server, ConnStateActive))
+	assert.False(t, s.setConnState(server, ConnStateClosed))
+	assert.Empty(t, s.conns)
+	mu.Lock()
+	assert.Zero(t, closed[server])
+	mu.Unlock()
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrNoCertificates = errors.New("no certificates configured")
+
+// CertPair names a PEM certificate chain and its private key on disk
+type CertPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// CertStore holds the server certificates, picks one per connection by SNI
+// and reloads them when their files change
+type CertStore struct {
+	pairs    []CertPair
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	modTimes []time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewCertStore loads every pair. the first one is served to clients that don't send SNI
+// or ask for a name no certificate covers
+func NewCertStore(pairs ...CertPair) (*CertStore, error) {
+	if len(pairs) == 0 {
+		return nil, ErrNoCertificates
+	}
+	store := &CertStore{
+		pairs:    pairs,
+		certs:    make([]*tls.Certificate, len(pairs)),
+		modTimes: make([]time.Time, len(pairs)),
+		stop:     make(chan struct{}),
+	}
+	for i := range pairs {
+		if _, err := store.load(i); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// TLSConfig returns a config serving the store's certificates and advertising http/1.1 over ALPN
+func (c *CertStore) TLSConfig() *tls.Config {
+	return withCertStore(nil, c)
+}
+
+// withCertStore copies base, or starts from defaults, and serves certificates from store
+func withCertStore(base *tls.Config, store *CertStore) *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		config = base.Clone()
+	}
+	config = withHTTP1(config)
+	config.Certificates = nil
+	config.GetCertificate = store.GetCertificate
+	return config
+}
+
+// GetCertificate picks the first certificate valid for the name the client asked for
+func (c *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if hello.ServerName != "" {
+		for _, cert := range c.certs {
+			if cert.Leaf != nil && cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return c.certs[0], nil
+}
+
+// Reload loads again every pair whose files changed since the last load.
+// a pair that fails to load keeps serving its previous certificate
+func (c *CertStore) Reload() error {
+	var errs []error
+	for i := range c.pairs {
+		if _, err := c.load(i); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Watch calls Reload every interval until Close
+func (c *CertStore) Watch(interval time.Duration, logger *log.Logger) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				if err := c.Reload(); err != nil {
+					logger.Printf("could not reload certificates: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops Watch
+func (c *CertStore) Close() error {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	return nil
+}
+
+// load reads pair i if its files are newer than what is loaded and reports whether it did
+func (c *CertStore) load(i int) (bool, error) {
+	pair := c.pairs[i]
+	modTime, err := latestModTime(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	unchanged := c.certs[i] != nil && !modTime.After(c.modTimes[i])
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("certificate %s: %w", pair.CertFile, err)
+	}
+
+	c.mu.Lock()
+	c.certs[i] = &cert
+	c.modTimes[i] = modTime
+	c.mu.Unlock()
+	return true, nil
+}
+
+// LoadCertPool reads PEM certificates, e.g. the CAs trusted to sign client certificates
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", file)
+		}
+	}
+	return pool, nil
+}
+
+// withHTTP1 advertises http/1.1 over ALPN unless base already lists protocols.
+// this server only speaks HTTP/1.1, clients asking for h2 alone are refused
+func withHTTP1(base *tls.Config) *tls.Config {
+	if len(base.NextProtos) > 0 {
+		return base
+	}
+	config := base.Clone()
+	config.NextProtos = []string{"http/1.1"}
+	return config
+}
+
+// withClientCAs copies base and requires client certificates verified against pool
+func withClientCAs(base *tls.Config, pool *x509.CertPool) *tls.Config {
+	config := base.Clone()
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	latest := time.Time{}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"tcpgo/internal/request"
+	"tcpgo/internal/response"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSelfSigned writes a self-signed certificate for names into dir and returns its pair
+func writeSelfSigned(t *testing.T, dir, commonName string, names ...string) CertPair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	pair := CertPair{
+		CertFile: filepath.Join(dir, names[0]+".crt"),
+		KeyFile:  filepath.Join(dir, names[0]+".key"),
+	}
+	require.NoError(t, os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return pair
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	first := writeSelfSigned(t, dir, "first", "first.test")
+	second := writeSelfSigned(t, dir, "second", "second.test")
+	s, err := ServeConfig(NewConfig(NewAddr("127.0.0.1:0"), NewCertificates(first, second)), helloHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	dial := func(serverName string, protos ...string) (*tls.Conn, error) {
+		return tls.Dial("tcp", s.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			NextProtos:         protos,
+			InsecureSkipVerify: true,
+		})
+	}
+
+	// TEST: Certificate picked by SNI, http/1.1 negotiated over ALPN
+	conn, err := dial("second.test", "h2", "http/1.1")
+	require.NoError(t, err)
+	state := conn.ConnectionState()
+	assert.Equal(t, "second", state.PeerCertificates[0].Subject.CommonName)
+	assert.Equal(t, "http/1.1", state.NegotiatedProtocol)
+	res := roundTrip(t, conn, "GET /tls HTTP/1.1\r\nConnection: close\r\n\r\n")
+	conn.Close()
+	assert.Contains(t, res, "hello /tls")
+
+	// TEST: Unknown name falls back to the first certificate
+	conn, err = dial("other.test")
+	require.NoError(t, err)
+	assert.Equal(t, "first", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	conn.Close()
+
+	// TEST: Client that only speaks h2 is refused
+	_, err = dial("first.test", "h2")
+	require.Error(t, err)
+}
+
+func TestServeTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeSelfSigned(t, dir, "plain", "plain.test")
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	require.NoError(t, err)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	s, err := ServeConfig(NewConfig(NewAddr("127.0.0.1:0"), NewTLSConfig(tlsConfig)), helloHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// TEST: A caller-supplied TLSConfig also negotiates http/1.1 and is left untouched
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{NextProtos: []string{"h2", "http/1.1"}, InsecureSkipVerify: true})
+	require.NoError(t, err)
+	assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+	res := roundTrip(t, conn, "GET /tls HTTP/1.1\r\nConnection: close\r\n\r\n")
+	conn.Close()
+	assert.Contains(t, res, "hello /tls")
+	assert.Empty(t, tlsConfig.NextProtos)
+
+	// TEST: Client that only speaks h2 is refused
+	_, err = tls.Dial("tcp", s.Addr().String(), &tls.Config{NextProtos: []string{"h2"}, InsecureSkipVerify: true})
+	require.Error(t, err)
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeSelfSigned(t, dir, "before", "reload.test")
+	store, err := NewCertStore(pair)
+	require.NoError(t, err)
+
+	// TEST: Unchanged files are not reloaded
+	require.NoError(t, store.Reload())
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "reload.test"})
+	require.NoError(t, err)
+	assert.Equal(t, "before", cert.Leaf.Subject.CommonName)
+
+	// TEST: Rewritten files are picked up
+	writeSelfSigned(t, dir, "after", "reload.test")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(pair.CertFile, later, later))
+	require.NoError(t, store.Reload())
+	cert, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "reload.test"})
+	require.NoError(t, err)
+	assert.Equal(t, "after", cert.Leaf.Subject.CommonName)
+
+	// TEST: A broken file keeps the previous certificate
+	require.NoError(t, os.WriteFile(pair.KeyFile, []byte("not a key"), 0o600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(pair.KeyFile, later, later))
+	require.Error(t, store.Reload())
+	cert, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "reload.test"})
+	require.NoError(t, err)
+	assert.Equal(t, "after", cert.Leaf.Subject.CommonName)
+}
+
+// signCertificate creates a certificate from template signed by parent, or self-signed when parent is nil
+func signCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverPair := writeSelfSigned(t, dir, "server", "server.test")
+	caTLS, ca := signCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600))
+	clientTLS, _ := signCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "billing", Organization: []string{"payments"}},
+		DNSNames:    []string{"billing.internal"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caTLS.PrivateKey.(*ecdsa.PrivateKey))
+
+	pool, err := LoadCertPool(caFile)
+	require.NoError(t, err)
+	s, err := ServeConfig(NewConfig(NewAddr("127.0.0.1:0"), NewCertificates(serverPair), NewClientCAs(pool)), func(w *response.Writer, req *request.Request) {
+		body := "anonymous"
+		if req.Peer != nil {
+			body = req.Peer.Subject.CommonName + " " + req.Peer.DNSNames[0] + " " + req.Peer.Subject.Organization[0]
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.NewResponseHeaders(response.NewContentLength(len(body))))
+		w.WriteBody([]byte(body))
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// TEST: Verified client identity reaches the handler
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientTLS},
+	})
+	require.NoError(t, err)
+	res := roundTrip(t, conn, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	conn.Close()
+	assert.Contains(t, res, "billing billing.internal payments")
+
+	// TEST: Client without a certificate is refused
+	conn, err = tls.Dial("tcp", s.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		// with TLS 1.3 the refusal arrives after the client side of the handshake
+		_, err = io.ReadAll(conn)
+		conn.Close()
+	}
+	require.Error(t, err)
+
+	// TEST: Client CAs without TLS
+	_, err = ServeConfig(NewConfig(NewAddr("127.0.0.1:0"), NewClientCAs(pool)), helloHandler)
+	require.Error(t, err)
+}